@@ -0,0 +1,852 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// resolveEntryPath returns the location of an archive entry inside root,
+// refusing names that are absolute or escape root via "..".
+func resolveEntryPath(root string, name string) (string, error) {
+	if filepath.IsAbs(name) {
+		return "", fmt.Errorf("absolute path in archive: %s", name)
+	}
+
+	path := filepath.Join(root, name)
+	if !isWithinRoot(root, path) {
+		return "", fmt.Errorf("path escapes bundle directory: %s", name)
+	}
+
+	return path, nil
+}
+
+func isWithinRoot(root string, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return false
+	}
+
+	return rel != ".." && !strings.HasPrefix(rel, "../")
+}
+
+// checkParents makes sure no directory between root and path is a symlink,
+// so an earlier entry can't redirect later writes outside of root.
+func checkParents(root string, path string) error {
+	rel, _ := filepath.Rel(root, filepath.Dir(path))
+	if rel == "." {
+		return nil
+	}
+
+	current := root
+	for _, part := range strings.Split(rel, string(filepath.Separator)) {
+		current = filepath.Join(current, part)
+
+		info, err := os.Lstat(current)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("path traverses symlink: %s", path)
+		}
+	}
+
+	return nil
+}
+
+// checkSymlinkTarget makes sure a symlink at path pointing at linkname stays
+// inside root on disk, not just lexically. ".." may only lead the target,
+// where it climbs the directories checkParents found to be real, and the
+// rest may not pass through an existing symlink, so neither an earlier nor
+// a later entry can redirect it outside of root.
+func checkSymlinkTarget(root string, path string, linkname string) error {
+	if filepath.IsAbs(linkname) {
+		return fmt.Errorf("absolute symlink in archive: %s -> %s", path, linkname)
+	}
+
+	current := filepath.Dir(path)
+	climbing, missing := true, false
+	for _, part := range strings.Split(filepath.ToSlash(linkname), "/") {
+		switch {
+		case part == "" || part == ".":
+			continue
+		case part == "..":
+			if !climbing {
+				return fmt.Errorf("symlink leaves a directory it entered: %s -> %s", path, linkname)
+			}
+			if current = filepath.Dir(current); !isWithinRoot(root, current) {
+				return fmt.Errorf("symlink escapes bundle directory: %s -> %s", path, linkname)
+			}
+			continue
+		}
+
+		climbing = false
+		current = filepath.Join(current, part)
+		if missing {
+			continue
+		}
+
+		info, err := os.Lstat(current)
+		if os.IsNotExist(err) {
+			missing = true
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("symlink traverses symlink: %s -> %s", path, linkname)
+		}
+	}
+
+	return nil
+}
+
+// removeEntry removes what an earlier entry left at path, other than a
+// directory, so the new entry replaces it instead of writing through it.
+func removeEntry(path string) error {
+	info, err := os.Lstat(path)
+	if err != nil || info.IsDir() {
+		return nil
+	}
+	return os.Remove(path)
+}
+
+// extractedDir is a directory whose mode and modification time are only
+// restored after everything below it was written, as writing changes both.
+type extractedDir struct {
+	path   string
+	header *tar.Header
+}
+
+// entryMode returns the permissions of header that are restored.
+func entryMode(header *tar.Header) os.FileMode {
+	return header.FileInfo().Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+}
+
+// restoreDirs applies the modes and modification times of dirs in reverse
+// order, so subdirectories are done before their parents, like GNU tar.
+// root keeps its owner's write bit, the cache marker is written into it.
+func restoreDirs(root string, dirs []extractedDir) error {
+	for i := len(dirs) - 1; i >= 0; i-- {
+		dir := dirs[i]
+
+		mode := entryMode(dir.header)
+		if dir.path == filepath.Clean(root) {
+			mode |= 0200
+		}
+
+		if err := os.Chmod(dir.path, mode); err != nil {
+			return err
+		}
+		if err := os.Chtimes(dir.path, dir.header.ModTime, dir.header.ModTime); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// extractEntry writes the entry at header to root. Directories are created
+// writable and added to dirs, restoreDirs applies their mode once done.
+func extractEntry(root string, header *tar.Header, reader io.Reader, dirs *[]extractedDir) error {
+	path, err := resolveEntryPath(root, header.Name)
+	if err != nil {
+		return err
+	}
+
+	if err := checkParents(root, path); err != nil {
+		return err
+	}
+
+	mode := entryMode(header)
+
+	switch header.Typeflag {
+	case tar.TypeDir:
+		if err := os.MkdirAll(path, 0700); err != nil {
+			return err
+		}
+		if err := chownEntry(path, header); err != nil {
+			return err
+		}
+		*dirs = append(*dirs, extractedDir{path, header})
+		return nil
+	case tar.TypeReg, tar.TypeRegA:
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+
+		/* O_EXCL never follows a symlink left at path */
+		if err := removeEntry(path); err != nil {
+			return err
+		}
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+
+		/* Write errors such as ENOSPC may only surface on close */
+		_, err = io.Copy(file, reader)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+
+		/* Chown clears setuid bits, and chmod isn't subject to the umask */
+		if err := chownEntry(path, header); err != nil {
+			return err
+		}
+		if err := os.Chmod(path, mode); err != nil {
+			return err
+		}
+		return os.Chtimes(path, header.ModTime, header.ModTime)
+	case tar.TypeSymlink:
+		if err := checkSymlinkTarget(root, path, header.Linkname); err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		if err := removeEntry(path); err != nil {
+			return err
+		}
+		if err := os.Symlink(header.Linkname, path); err != nil {
+			return err
+		}
+		return chownEntry(path, header)
+	case tar.TypeLink:
+		target, err := resolveEntryPath(root, header.Linkname)
+		if err != nil {
+			return err
+		}
+		if err := checkParents(root, target); err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		if err := removeEntry(path); err != nil {
+			return err
+		}
+		return os.Link(target, path)
+	}
+
+	return nil
+}
+
+var (
+	// chownPreserve restores the owners recorded in the archive.
+	chownPreserve bool
+	// chownUID and chownGID own every extracted file unless -1.
+	chownUID = -1
+	chownGID = -1
+)
+
+// parseChown resolves --chown up front: current-user leaves extracted files
+// owned by whoever runs bundle_cache, preserve restores the owners of the
+// archived files and user[:group] sets the owner, by name or ID.
+func parseChown() {
+	switch options.Chown {
+	case "current-user":
+	case "preserve":
+		chownPreserve = true
+	default:
+		var err error
+		if chownUID, chownGID, err = lookupOwner(options.Chown); err != nil {
+			terminate(fmt.Sprintf("Invalid --chown: %s", err), ERR_WRONG_USAGE)
+		}
+	}
+}
+
+// lookupOwner returns the IDs of user[:group]. Without a group the user's
+// primary group is used.
+func lookupOwner(owner string) (int, int, error) {
+	name, group := owner, ""
+	if i := strings.IndexByte(owner, ':'); i >= 0 {
+		name, group = owner[:i], owner[i+1:]
+	}
+
+	uid, err := strconv.Atoi(name)
+	gid := -1
+	if err != nil {
+		account, err := user.Lookup(name)
+		if err != nil {
+			return 0, 0, err
+		}
+		uid, _ = strconv.Atoi(account.Uid)
+		gid, _ = strconv.Atoi(account.Gid)
+	}
+
+	if len(group) > 0 {
+		if gid, err = strconv.Atoi(group); err != nil {
+			found, err := user.LookupGroup(group)
+			if err != nil {
+				return 0, 0, err
+			}
+			gid, _ = strconv.Atoi(found.Gid)
+		}
+	}
+
+	return uid, gid, nil
+}
+
+// chownEntry sets the owner of an extracted entry according to --chown.
+func chownEntry(path string, header *tar.Header) error {
+	switch {
+	case chownPreserve:
+		return os.Lchown(path, header.Uid, header.Gid)
+	case chownUID >= 0:
+		return os.Lchown(path, chownUID, chownGID)
+	}
+
+	return nil
+}
+
+type archiveEntry struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+	Mode string `json:"mode"`
+}
+
+// walkArchive calls fn for every entry of the archive, with a reader for the
+// contents of regular files.
+func walkArchive(reader io.Reader, fn func(*tar.Header, io.Reader) error) error {
+	buffered := bufio.NewReader(reader)
+	if magic, _ := buffered.Peek(len(zipMagic)); bytes.Equal(magic, zipMagic) {
+		return walkZip(reader, buffered, fn)
+	}
+
+	decompressed, err := decompress(buffered)
+	if err != nil {
+		return err
+	}
+	defer decompressed.Close()
+
+	archive := tar.NewReader(decompressed)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := fn(header, archive); err != nil {
+			return err
+		}
+	}
+}
+
+// listArchive reads the archive headers without writing anything to disk.
+func listArchive(reader io.Reader) ([]archiveEntry, error) {
+	var entries []archiveEntry
+
+	err := walkArchive(reader, func(header *tar.Header, _ io.Reader) error {
+		entries = append(entries, archiveEntry{
+			Path: header.Name,
+			Size: header.Size,
+			Mode: header.FileInfo().Mode().String(),
+		})
+		return nil
+	})
+
+	return entries, err
+}
+
+func extractTar(reader io.Reader, root string) error {
+	var dirs []extractedDir
+	if err := extractEntries(reader, root, &dirs); err != nil {
+		return err
+	}
+
+	return restoreDirs(root, dirs)
+}
+
+// extractEntries extracts the archive like extractTar, adding directories to
+// dirs instead of restoring them, for archives applied on top of another.
+func extractEntries(reader io.Reader, root string, dirs *[]extractedDir) error {
+	return walkArchive(reader, func(header *tar.Header, contents io.Reader) error {
+		return extractEntry(root, header, contents, dirs)
+	})
+}
+
+// createArchive archives dirs into a compressed tar file at path. A single
+// directory is archived like `tar -czf path .` run inside it. With several,
+// the entries of each directory are stored below its index, so "1/cache/x"
+// is "cache/x" of the second directory.
+func createArchive(path string, dirs []string) error {
+	return writeArchive(path, func(archive *tar.Writer) error {
+		return addTargets(archive, dirs)
+	})
+}
+
+// addTargets adds dirs in the layout described at createArchive.
+func addTargets(archive *tar.Writer, dirs []string) error {
+	if len(dirs) == 1 {
+		return addTree(archive, dirs[0], ".", "")
+	}
+
+	for i, dir := range dirs {
+		if err := addTree(archive, dir, strconv.Itoa(i), ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeArchive creates a tar file at path, compressed with --compression,
+// or a zip file with --format=zip, with the entries added by fn.
+func writeArchive(path string, fn func(*tar.Writer) error) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if err := writeArchiveTo(file, fn); err != nil {
+		return err
+	}
+
+	return file.Close()
+}
+
+// archivedBytes counts the bytes of the tar streams fed to the compressor,
+// the uncompressed size for --compression-stats.
+var archivedBytes int64
+
+// writeArchiveTo writes the archive described at writeArchive to w.
+func writeArchiveTo(w io.Writer, fn func(*tar.Writer) error) error {
+	if archiveFormat() == "zip" {
+		return writeZip(w, fn)
+	}
+
+	compressed, err := compress(w)
+	if err != nil {
+		return err
+	}
+	archive := tar.NewWriter(countingWriter{compressed, &archivedBytes})
+
+	if err := fn(archive); err != nil {
+		return err
+	}
+
+	if err := archive.Close(); err != nil {
+		return err
+	}
+	return compressed.Close()
+}
+
+// addTree adds root and everything below it, named relative to root and
+// prefixed with name. base is the path of root within the cached directory,
+// which --exclude patterns are relative to.
+func addTree(archive *tar.Writer, root string, name string, base string) error {
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+
+		if rel != "." && isExcluded(filepath.ToSlash(filepath.Join(base, rel))) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		entry := name
+		if rel != "." {
+			entry = fmt.Sprintf("%s/%s", name, filepath.ToSlash(rel))
+		}
+
+		return addTarEntry(archive, entry, path, info)
+	})
+}
+
+// excludePattern is an --exclude glob. Patterns without a slash match names
+// at any depth, like `tar --exclude`, others the path within the cached
+// directory.
+type excludePattern struct {
+	pattern  *regexp.Regexp
+	anchored bool
+}
+
+var excludePatterns []excludePattern
+
+// parseExcludes compiles --exclude up front, so invalid patterns fail before
+// any transfer.
+func parseExcludes() {
+	for _, exclude := range options.Exclude {
+		glob := strings.Trim(exclude, "/")
+
+		pattern, err := globPattern(glob)
+		if err != nil {
+			terminate(fmt.Sprintf("Invalid --exclude pattern: %s", err), ERR_WRONG_USAGE)
+		}
+
+		excludePatterns = append(excludePatterns, excludePattern{pattern, strings.Contains(glob, "/")})
+	}
+}
+
+// isExcluded reports whether rel, a slash separated path within a cached
+// directory, matches an --exclude pattern. Everything below an excluded
+// directory is left out with it.
+func isExcluded(rel string) bool {
+	for _, exclude := range excludePatterns {
+		name := rel
+		if !exclude.anchored {
+			name = path.Base(rel)
+		}
+
+		if exclude.pattern.MatchString(name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// normalizeHeader drops what differs between two installs of the same
+// files, so --reproducible archives of equal directories are byte for byte
+// equal: entries get the mtime from SOURCE_DATE_EPOCH, or the Unix epoch,
+// and belong to root. Entries are in lexical order already, as written by
+// filepath.Walk, and access and change times are only written in formats
+// never picked for these headers.
+func normalizeHeader(header *tar.Header) {
+	var epoch int64
+	if value, err := strconv.ParseInt(os.Getenv("SOURCE_DATE_EPOCH"), 10, 64); err == nil {
+		epoch = value
+	}
+
+	header.ModTime = time.Unix(epoch, 0)
+	header.AccessTime = time.Time{}
+	header.ChangeTime = time.Time{}
+	header.Uid = 0
+	header.Gid = 0
+	header.Uname = ""
+	header.Gname = ""
+}
+
+// addTarEntry writes a directory, regular file or symlink as name. Other
+// file types, such as sockets, are skipped.
+func addTarEntry(archive *tar.Writer, name string, path string, info os.FileInfo) error {
+	var link string
+
+	switch {
+	case info.IsDir():
+		name += "/"
+	case info.Mode()&os.ModeSymlink != 0:
+		var err error
+		if link, err = os.Readlink(path); err != nil {
+			return err
+		}
+	case !info.Mode().IsRegular():
+		return nil
+	}
+
+	header, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return err
+	}
+	header.Name = name
+
+	if options.Reproducible {
+		normalizeHeader(header)
+	}
+
+	if err := archive.WriteHeader(header); err != nil {
+		return err
+	}
+
+	if !info.Mode().IsRegular() {
+		return nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = io.Copy(archive, file)
+	return err
+}
+
+// splitTargetEntry returns the directory index and the name within that
+// directory of an entry in an archive of several directories.
+func splitTargetEntry(name string, count int) (int, string, error) {
+	parts := strings.SplitN(name, "/", 2)
+
+	index, err := strconv.Atoi(parts[0])
+	if err != nil || index < 0 || index >= count {
+		return 0, "", fmt.Errorf("unexpected entry in archive: %s", name)
+	}
+
+	if len(parts) == 1 {
+		return index, "", nil
+	}
+
+	return index, parts[1], nil
+}
+
+// extractMultiTar unpacks an archive of several directories into one
+// root per directory. Entries of directories without a root are skipped.
+func extractMultiTar(reader io.Reader, roots []string) error {
+	dirs := make([][]extractedDir, len(roots))
+
+	err := walkArchive(reader, func(header *tar.Header, contents io.Reader) error {
+		index, name, err := splitTargetEntry(header.Name, len(roots))
+		if err != nil {
+			return err
+		}
+		if len(roots[index]) == 0 || len(name) == 0 {
+			return nil
+		}
+		header.Name = name
+
+		if header.Typeflag == tar.TypeLink {
+			linkIndex, linkname, err := splitTargetEntry(header.Linkname, len(roots))
+			if err != nil {
+				return err
+			}
+			if linkIndex != index {
+				return fmt.Errorf("hard link across directories: %s", header.Linkname)
+			}
+			header.Linkname = linkname
+		}
+
+		return extractEntry(roots[index], header, contents, &dirs[index])
+	})
+	if err != nil {
+		return err
+	}
+
+	for index, root := range roots {
+		if err := restoreDirs(root, dirs[index]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// printCompressionStats prints the size of the tar stream written by
+// writeArchiveTo against the compressed size of the archive.
+func printCompressionStats(compressed int64, elapsed time.Duration) {
+	original := atomic.LoadInt64(&archivedBytes)
+
+	ratio := 0.0
+	if original > 0 {
+		ratio = float64(compressed) / float64(original)
+	}
+
+	if options.JSON {
+		json.NewEncoder(os.Stdout).Encode(map[string]interface{}{
+			"uncompressed_bytes": original,
+			"compressed_bytes":   compressed,
+			"ratio":              ratio,
+			"seconds":            elapsed.Seconds(),
+		})
+		return
+	}
+
+	fmt.Printf("Original size:   %d bytes\n", original)
+	fmt.Printf("Compressed size: %d bytes\n", compressed)
+	fmt.Printf("Ratio:           %.2f\n", ratio)
+	fmt.Printf("Time:            %s\n", elapsed)
+}
+
+// extractStream unpacks into a staging directory next to target and only
+// moves it into place once every entry was written, so a failed or partial
+// extraction never leaves a bundle behind.
+func extractStream(reader io.Reader, targets []string) bool {
+	return extractVerified(reader, targets, nil)
+}
+
+// extractVerified is extractStream calling verify, if given, once every
+// entry was written and before anything is moved into place.
+func extractVerified(reader io.Reader, targets []string, verify func() error) bool {
+	if len(targets) > 1 {
+		return extractTargets(reader, targets, verify)
+	}
+
+	staging, ok := createStaging(targets[0])
+	if !ok {
+		return false
+	}
+
+	err := extractTar(reader, staging)
+	if err == nil && verify != nil {
+		err = verify()
+	}
+	if err != nil {
+		fmt.Println("Unable to extract:", err)
+		removeTree(staging)
+		return false
+	}
+
+	return commitStaging(staging, targets[0])
+}
+
+// extractTargets stages every target like extractStream. Targets other than
+// the first, such as a registry shared between projects, are left as they
+// are when they already exist.
+func extractTargets(reader io.Reader, targets []string, verify func() error) bool {
+	stagings := make([]string, len(targets))
+	removeStagings := func() {
+		for _, staging := range stagings {
+			if len(staging) > 0 {
+				removeTree(staging)
+			}
+		}
+	}
+
+	for i, target := range targets {
+		if _, err := os.Lstat(target); err == nil && i > 0 {
+			fmt.Printf("Keeping existing '%s'\n", target)
+			continue
+		}
+
+		staging, ok := createStaging(target)
+		if !ok {
+			removeStagings()
+			return false
+		}
+		stagings[i] = staging
+	}
+
+	err := extractMultiTar(reader, stagings)
+	if err == nil && verify != nil {
+		err = verify()
+	}
+	if err != nil {
+		fmt.Println("Unable to extract:", err)
+		removeStagings()
+		return false
+	}
+
+	/* The first target goes last, as its presence marks a restored bundle */
+	for i := len(stagings) - 1; i >= 0; i-- {
+		if len(stagings[i]) == 0 {
+			continue
+		}
+
+		ok := commitStaging(stagings[i], targets[i])
+		stagings[i] = ""
+		if !ok {
+			removeStagings()
+			return false
+		}
+	}
+
+	return true
+}
+
+// createStaging prepares the staging directory of target. An existing target
+// is only allowed with --refresh-if-stale, commitStaging replaces it then.
+func createStaging(target string) (string, bool) {
+	if _, err := os.Lstat(target); err == nil && !options.RefreshIfStale {
+		fmt.Printf("Bundle directory '%s' already exists\n", target)
+		return "", false
+	}
+
+	staging := fmt.Sprintf("%s.partial", target)
+	if err := removeTree(staging); err != nil {
+		fmt.Println("Unable to remove stale staging directory:", err)
+		return "", false
+	}
+
+	if err := os.MkdirAll(staging, 0755); err != nil {
+		fmt.Println("Unable to create bundle directory:", err)
+		return "", false
+	}
+
+	return staging, true
+}
+
+// commitStaging moves staging into place. A stale bundle at target is moved
+// aside first and only removed once the new one took its place.
+func commitStaging(staging string, target string) bool {
+	stale := fmt.Sprintf("%s.stale", target)
+	if _, err := os.Lstat(target); err == nil {
+		if err := removeTree(stale); err != nil {
+			fmt.Println("Unable to remove stale bundle:", err)
+			removeTree(staging)
+			return false
+		}
+		if err := os.Rename(target, stale); err != nil {
+			fmt.Println("Unable to move stale bundle aside:", err)
+			removeTree(staging)
+			return false
+		}
+	}
+
+	if err := os.Rename(staging, target); err != nil {
+		fmt.Println("Unable to move bundle into place:", err)
+		os.Rename(stale, target)
+		removeTree(staging)
+		return false
+	}
+
+	if err := removeTree(stale); err != nil {
+		fmt.Fprintln(os.Stderr, "Warning: unable to remove stale bundle:", err)
+	}
+
+	return true
+}
+
+// removeTree removes path like os.RemoveAll, first making directories
+// writable when needed, as Go leaves its module cache read-only.
+func removeTree(path string) error {
+	if err := os.RemoveAll(path); err == nil || !errors.Is(err, fs.ErrPermission) {
+		return err
+	}
+
+	filepath.Walk(path, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.IsDir() {
+			os.Chmod(path, info.Mode().Perm()|0700)
+		}
+		return nil
+	})
+
+	return os.RemoveAll(path)
+}
+
+func extractArchive(filename string, targets []string) bool {
+	file, err := os.Open(filename)
+	if err != nil {
+		fmt.Println("Unable to open archive:", err)
+		return false
+	}
+	defer file.Close()
+
+	ok := extractStream(file, targets)
+	if err := os.Remove(filename); err != nil {
+		fmt.Println("Unable to remove archive")
+		return false
+	}
+
+	return ok
+}
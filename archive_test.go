@@ -0,0 +1,283 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testEntry struct {
+	name     string
+	linkname string
+	hardlink bool
+	contents string
+}
+
+// buildTarGz archives entries in memory, as symlinks when linkname is set,
+// or hard links with hardlink.
+func buildTarGz(t *testing.T, entries []testEntry) *bytes.Buffer {
+	t.Helper()
+
+	var buffer bytes.Buffer
+	compressed := gzip.NewWriter(&buffer)
+	archive := tar.NewWriter(compressed)
+
+	for _, entry := range entries {
+		header := &tar.Header{Name: entry.name, Mode: 0644, Typeflag: tar.TypeReg, Size: int64(len(entry.contents))}
+		if len(entry.linkname) > 0 {
+			header = &tar.Header{Name: entry.name, Mode: 0777, Typeflag: tar.TypeSymlink, Linkname: entry.linkname}
+		}
+		if entry.hardlink {
+			header.Typeflag = tar.TypeLink
+		}
+
+		if err := archive.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := archive.Write([]byte(entry.contents)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := archive.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := compressed.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return &buffer
+}
+
+func TestExtractTarRejectsEscapingEntries(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries func(outside string) []testEntry
+	}{
+		{"parent directory", func(string) []testEntry {
+			return []testEntry{{name: "../x", contents: "escaped"}}
+		}},
+		{"nested parent directory", func(string) []testEntry {
+			return []testEntry{{name: "gems/../../x", contents: "escaped"}}
+		}},
+		{"absolute path", func(outside string) []testEntry {
+			return []testEntry{{name: filepath.Join(outside, "abs"), contents: "escaped"}}
+		}},
+		{"symlink escaping root", func(string) []testEntry {
+			return []testEntry{{name: "link", linkname: "../outside"}}
+		}},
+		{"absolute symlink", func(outside string) []testEntry {
+			return []testEntry{{name: "link", linkname: outside}}
+		}},
+		{"write through symlinked parent", func(string) []testEntry {
+			return []testEntry{
+				{name: "inner/keep", contents: "kept"},
+				{name: "link", linkname: "inner"},
+				{name: "link/x", contents: "redirected"},
+			}
+		}},
+		{"symlink chained through symlink", func(string) []testEntry {
+			return []testEntry{
+				{name: "d/keep", contents: "kept"},
+				{name: "d/up", linkname: ".."},
+				{name: "t", linkname: "d/up/../pwned"},
+				{name: "t", contents: "escaped"},
+			}
+		}},
+		{"symlink through existing symlink", func(string) []testEntry {
+			return []testEntry{
+				{name: "d/keep", contents: "kept"},
+				{name: "d/up", linkname: ".."},
+				{name: "t", linkname: "d/up/pwned"},
+			}
+		}},
+		{"hard link through symlinked parent", func(string) []testEntry {
+			return []testEntry{
+				{name: "inner/keep", contents: "kept"},
+				{name: "link", linkname: "inner"},
+				{name: "x", linkname: "link/keep", hardlink: true},
+			}
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			root := filepath.Join(dir, "bundle")
+			outside := filepath.Join(dir, "outside")
+			for _, path := range []string{root, outside} {
+				if err := os.Mkdir(path, 0755); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := extractTar(buildTarGz(t, test.entries(outside)), root); err == nil {
+				t.Fatal("expected extraction to fail")
+			}
+
+			for _, path := range []string{filepath.Join(root, "inner", "x"), filepath.Join(root, "x")} {
+				if _, err := os.Lstat(path); err == nil {
+					t.Errorf("%s was written", path)
+				}
+			}
+
+			for _, path := range []string{dir, outside} {
+				written, err := ioutil.ReadDir(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, info := range written {
+					if path == outside || info.Name() != "bundle" && info.Name() != "outside" {
+						t.Errorf("%s written outside the bundle directory", filepath.Join(path, info.Name()))
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestExtractTarKeepsEntriesInsideRoot(t *testing.T) {
+	root := t.TempDir()
+	archive := buildTarGz(t, []testEntry{
+		{name: "./gems/a/lib.rb", contents: "puts 1"},
+		{name: "gems/b/../c.rb", contents: "puts 2"},
+		{name: "gems/current", linkname: "a"},
+		{name: "bin/rake", linkname: "../gems/a/lib.rb"},
+		{name: "bin/rake", contents: "replaced"},
+		{name: "gems/c-link.rb", linkname: "gems/c.rb", hardlink: true},
+	})
+
+	if err := extractTar(archive, root); err != nil {
+		t.Fatal(err)
+	}
+
+	for path, want := range map[string]string{
+		"gems/a/lib.rb":       "puts 1",
+		"gems/c.rb":           "puts 2",
+		"gems/current/lib.rb": "puts 1",
+		"bin/rake":            "replaced",
+		"gems/c-link.rb":      "puts 2",
+	} {
+		got, err := ioutil.ReadFile(filepath.Join(root, path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Errorf("%s = %q, want %q", path, got, want)
+		}
+	}
+}
+
+func TestExtractStreamRemovesStagingOnWriteError(t *testing.T) {
+	/* The header promises more bytes than the body holds */
+	var buffer bytes.Buffer
+	archive := tar.NewWriter(&buffer)
+	contents := bytes.Repeat([]byte("x"), 64<<10)
+	if err := archive.WriteHeader(&tar.Header{Name: "gems/big", Mode: 0644, Typeflag: tar.TypeReg, Size: int64(len(contents))}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := archive.Write(contents); err != nil {
+		t.Fatal(err)
+	}
+	truncated := bytes.NewReader(buffer.Bytes()[:512+1024])
+
+	target := filepath.Join(t.TempDir(), "bundle")
+	if extractStream(truncated, []string{target}) {
+		t.Fatal("expected extraction to fail")
+	}
+
+	for _, path := range []string{target + ".partial", target, filepath.Join(target, ".cache")} {
+		if _, err := os.Lstat(path); err == nil {
+			t.Errorf("%s was left behind", path)
+		}
+	}
+}
+
+func TestExtractStreamKeepsTargetOnWriteError(t *testing.T) {
+	defer func(refresh bool) { options.RefreshIfStale = refresh }(options.RefreshIfStale)
+	options.RefreshIfStale = true
+
+	target := filepath.Join(t.TempDir(), "bundle")
+	if err := os.Mkdir(target, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(target, "old.rb"), []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	/* Creating the second file fails, even for root */
+	archive := buildTarGz(t, []testEntry{
+		{name: "gems/a.rb", contents: "puts 1"},
+		{name: "gems/" + strings.Repeat("x", 300), contents: "puts 2"},
+	})
+	if extractStream(archive, []string{target}) {
+		t.Fatal("expected extraction to fail")
+	}
+
+	for _, path := range []string{target + ".partial", target + ".stale", filepath.Join(target, "gems")} {
+		if _, err := os.Lstat(path); err == nil {
+			t.Errorf("%s was left behind", path)
+		}
+	}
+	if got, err := ioutil.ReadFile(filepath.Join(target, "old.rb")); err != nil || string(got) != "old" {
+		t.Errorf("old bundle was not kept: %q, %v", got, err)
+	}
+}
+
+func TestExtractTarRestoresDirectoriesLast(t *testing.T) {
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	var buffer bytes.Buffer
+	archive := tar.NewWriter(&buffer)
+	for _, header := range []*tar.Header{
+		{Name: "./", Mode: 0555, Typeflag: tar.TypeDir, ModTime: modTime},
+		{Name: "gems/", Mode: 0555, Typeflag: tar.TypeDir, ModTime: modTime},
+		{Name: "gems/a/", Mode: 0500, Typeflag: tar.TypeDir, ModTime: modTime},
+		{Name: "gems/a/lib.rb", Mode: 0444, Typeflag: tar.TypeReg, ModTime: modTime, Size: 6},
+	} {
+		if err := archive.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := archive.Write([]byte("puts 1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := archive.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	root := filepath.Join(t.TempDir(), "bundle")
+	t.Cleanup(func() { removeTree(root) })
+	if err := os.Mkdir(root, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := extractTar(&buffer, root); err != nil {
+		t.Fatal(err)
+	}
+
+	/* The bundle directory stays writable for the cache marker */
+	for path, want := range map[string]os.FileMode{
+		".":             0755,
+		"gems":          0555,
+		"gems/a":        0500,
+		"gems/a/lib.rb": 0444,
+	} {
+		info, err := os.Lstat(filepath.Join(root, path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != want {
+			t.Errorf("%s has mode %s, want %s", path, info.Mode().Perm(), want)
+		}
+		if !info.ModTime().Equal(modTime) {
+			t.Errorf("%s was modified at %s, want %s", path, info.ModTime(), modTime)
+		}
+	}
+}
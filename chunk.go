@@ -0,0 +1,330 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Experimental --chunked mode, in the style of restic and casync: the
+// uncompressed tarball of the bundle is cut into chunks at boundaries found
+// by a rolling hash of the content, so an insertion only changes the chunks
+// around it. Every chunk is compressed and stored once under its hash, and
+// a manifest per archive key lists the chunks making up the tarball.
+
+const (
+	chunkMin = 512 << 10
+	chunkMax = 4 << 20
+	/* Cuts where the low 20 bits of the hash are zero, 1 MB on average */
+	chunkMask = 1<<20 - 1
+
+	chunkConcurrency = 8
+)
+
+// gearTable holds the random values the rolling hash adds per byte. They
+// must never change, or no chunk would be found again.
+var gearTable = func() [256]uint64 {
+	var table [256]uint64
+
+	/* splitmix64 with a fixed seed */
+	state := uint64(0x62756e646c655f63)
+	for i := range table {
+		state += 0x9e3779b97f4a7c15
+		z := state
+		z = (z ^ z>>30) * 0xbf58476d1ce4e5b9
+		z = (z ^ z>>27) * 0x94d049bb133111eb
+		table[i] = z ^ z>>31
+	}
+
+	return table
+}()
+
+var chunkHashPattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+type chunkManifest struct {
+	Chunks []string `json:"chunks"`
+	Size   int64    `json:"size"`
+}
+
+func chunkManifestKey() string {
+	return fmt.Sprintf("%s.chunks.json", strings.TrimSuffix(options.ArchiveKey, options.ArchiveExt))
+}
+
+// chunkKey stores chunks of every scope and lockfile of a project together,
+// which is where they are shared.
+func chunkKey(hash string) string {
+	ext := strings.TrimPrefix(options.ArchiveExt, ".tar")
+	return path.Join(path.Dir(options.ArchiveKey), options.Prefix+"_chunks", hash[:2], hash+ext)
+}
+
+// chunkBoundary returns the length of the next chunk at the start of data,
+// which is all of it when no boundary is found.
+func chunkBoundary(data []byte) int {
+	if len(data) <= chunkMin {
+		return len(data)
+	}
+
+	var hash uint64
+	for i := chunkMin; i < len(data); i++ {
+		hash = hash<<1 + gearTable[data[i]]
+		if hash&chunkMask == 0 {
+			return i + 1
+		}
+	}
+
+	return len(data)
+}
+
+// splitChunks calls fn with every chunk of reader. The chunk is only valid
+// until fn returns.
+func splitChunks(reader io.Reader, fn func([]byte) error) error {
+	buffer := make([]byte, chunkMax)
+	pending := 0
+
+	for eof := false; !eof || pending > 0; {
+		if !eof {
+			n, err := io.ReadFull(reader, buffer[pending:])
+			pending += n
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				eof = true
+			} else if err != nil {
+				return err
+			}
+		}
+		if pending == 0 {
+			break
+		}
+
+		cut := chunkBoundary(buffer[:pending])
+		if err := fn(buffer[:cut]); err != nil {
+			return err
+		}
+
+		copy(buffer, buffer[cut:pending])
+		pending -= cut
+	}
+
+	return nil
+}
+
+func uploadChunk(backend Backend, key string, chunk []byte) error {
+	var compressed bytes.Buffer
+
+	writer, err := compress(&compressed)
+	if err != nil {
+		return err
+	}
+	if _, err := writer.Write(chunk); err != nil {
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+
+	return backend.Put(key, bytes.NewReader(compressed.Bytes()), int64(compressed.Len()))
+}
+
+func uploadChunks(backend Backend) {
+	reader, writer := io.Pipe()
+	go func() {
+		archive := tar.NewWriter(writer)
+		err := addTargets(archive, options.TargetPaths)
+		if err == nil {
+			err = archive.Close()
+		}
+		writer.CloseWithError(err)
+	}()
+
+	var manifest chunkManifest
+	var uploaded, uploadedBytes int
+
+	/* Chunks repeated within the tarball are only sent once */
+	seen := make(map[string]bool)
+
+	var mutex sync.Mutex
+	var wait sync.WaitGroup
+	var firstErr error
+	slots := make(chan struct{}, chunkConcurrency)
+
+	fmt.Println("Uploading chunks...")
+	err := splitChunks(reader, func(data []byte) error {
+		hash := fmt.Sprintf("%x", sha256.Sum256(data))
+		manifest.Chunks = append(manifest.Chunks, hash)
+		manifest.Size += int64(len(data))
+
+		if seen[hash] {
+			return nil
+		}
+		seen[hash] = true
+
+		key := chunkKey(hash)
+		chunk := append([]byte{}, data...)
+		slots <- struct{}{}
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			defer func() { <-slots }()
+
+			/* Looked up in parallel too, a round trip per chunk adds up */
+			if exists, _ := backend.Exists(key); exists {
+				return
+			}
+
+			err := uploadChunk(backend, key, chunk)
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			if err != nil {
+				if firstErr == nil {
+					firstErr = fmt.Errorf("%s: %s", hash, err)
+				}
+				return
+			}
+			uploaded++
+			uploadedBytes += len(chunk)
+		}()
+		return nil
+	})
+	wait.Wait()
+	reader.CloseWithError(err)
+
+	if err != nil {
+		terminate(fmt.Sprintf("Failed to make archive: %s", err), 1)
+	}
+	if firstErr != nil {
+		terminate(fmt.Sprintf("Failed to upload chunk %s", firstErr), ERR_UPLOAD)
+	}
+
+	/* Every chunk is stored before the manifest referencing it */
+	body, _ := json.Marshal(manifest)
+	if err := backend.Put(chunkManifestKey(), bytes.NewReader(body), int64(len(body))); err != nil {
+		terminate(fmt.Sprintf("Failed to upload chunk manifest: %s", err), ERR_UPLOAD)
+	}
+
+	metrics.Bytes = int64(uploadedBytes)
+	fmt.Printf("%d of %d chunks uploaded, %d of %d bytes\n", uploaded, len(manifest.Chunks), uploadedBytes, manifest.Size)
+}
+
+func fetchChunkManifest(backend Backend) chunkManifest {
+	body, err := backend.Get(chunkManifestKey())
+	if err != nil {
+		terminate(fmt.Sprintf("Unable to fetch chunk manifest: %s", err), ERR_CACHE_MISS)
+	}
+	defer body.Close()
+
+	var manifest chunkManifest
+	if err := json.NewDecoder(body).Decode(&manifest); err != nil {
+		terminate(fmt.Sprintf("Invalid chunk manifest: %s", err), ERR_EXTRACT)
+	}
+
+	/* Hashes name the chunk objects, so they must not reach outside them */
+	for _, hash := range manifest.Chunks {
+		if !chunkHashPattern.MatchString(hash) {
+			terminate(fmt.Sprintf("Invalid chunk manifest: bad chunk hash %q", hash), ERR_EXTRACT)
+		}
+	}
+
+	return manifest
+}
+
+type fetchedChunk struct {
+	data []byte
+	// size is the number of bytes downloaded.
+	size int64
+	err  error
+}
+
+// fetchChunk downloads and decompresses a chunk, checking it against its
+// hash.
+func fetchChunk(backend Backend, hash string) fetchedChunk {
+	body, err := backend.Get(chunkKey(hash))
+	if err != nil {
+		return fetchedChunk{err: err}
+	}
+	defer body.Close()
+
+	compressed, err := ioutil.ReadAll(body)
+	if err != nil {
+		return fetchedChunk{err: err}
+	}
+
+	decompressed, err := decompress(bytes.NewReader(compressed))
+	if err != nil {
+		return fetchedChunk{err: err}
+	}
+	defer decompressed.Close()
+
+	chunk, err := ioutil.ReadAll(decompressed)
+	if err != nil {
+		return fetchedChunk{err: err}
+	}
+
+	if fmt.Sprintf("%x", sha256.Sum256(chunk)) != hash {
+		return fetchedChunk{err: fmt.Errorf("checksum mismatch")}
+	}
+
+	return fetchedChunk{chunk, int64(len(compressed)), nil}
+}
+
+// writeChunks writes the chunks of manifest to writer in order, fetching up
+// to chunkConcurrency of them ahead.
+func writeChunks(backend Backend, manifest chunkManifest, writer *io.PipeWriter) {
+	results := make([]chan fetchedChunk, len(manifest.Chunks))
+	for i := range results {
+		results[i] = make(chan fetchedChunk, 1)
+	}
+
+	slots := make(chan struct{}, chunkConcurrency)
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		for i, hash := range manifest.Chunks {
+			/* Slots are taken in order, so the next chunk always has one */
+			select {
+			case slots <- struct{}{}:
+			case <-done:
+				return
+			}
+
+			go func(result chan fetchedChunk, hash string) {
+				result <- fetchChunk(backend, hash)
+			}(results[i], hash)
+		}
+	}()
+
+	for i, hash := range manifest.Chunks {
+		result := <-results[i]
+		<-slots
+		if result.err != nil {
+			writer.CloseWithError(fmt.Errorf("chunk %s: %s", hash, result.err))
+			return
+		}
+		metrics.Bytes += result.size
+
+		if _, err := writer.Write(result.data); err != nil {
+			return
+		}
+	}
+
+	writer.Close()
+}
+
+func downloadChunks(backend Backend) bool {
+	manifest := fetchChunkManifest(backend)
+
+	reader, writer := io.Pipe()
+	go writeChunks(backend, manifest, writer)
+
+	ok := extractStream(reader, options.RestorePaths)
+	reader.Close()
+	return ok
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"runtime"
+	"sort"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/klauspost/pgzip"
+	"github.com/pierrec/lz4/v4"
+)
+
+// codec compresses archives with --compression. Archives are decompressed
+// by their magic bytes instead, so any archive can be restored whatever the
+// current setting.
+type codec struct {
+	// Ext is the extension of archives, which is part of their key.
+	Ext string
+	// NewWriter compresses to w at level, or the default level for -1, on
+	// up to threads cores.
+	NewWriter func(w io.Writer, level int, threads int) (io.WriteCloser, error)
+}
+
+var codecs = map[string]codec{
+	"gzip": {".tar.gz", newGzipWriter},
+	"zstd": {".tar.zst", newZstdWriter},
+	"lz4":  {".tar.lz4", newLz4Writer},
+	"none": {".tar", newStoreWriter},
+}
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	lz4Magic  = []byte{0x04, 0x22, 0x4d, 0x18}
+	/* At offset tarMagicOffset of the first header */
+	tarMagic = []byte("ustar")
+)
+
+const tarMagicOffset = 257
+
+// storeWriter writes the tarball as it is, for fast links where compressing
+// takes longer than transferring the difference.
+type storeWriter struct {
+	io.Writer
+}
+
+func (storeWriter) Close() error {
+	return nil
+}
+
+func newStoreWriter(w io.Writer, level int, threads int) (io.WriteCloser, error) {
+	return storeWriter{w}, nil
+}
+
+// gzipBlockSize is the amount of input pgzip compresses per goroutine.
+const gzipBlockSize = 1 << 20
+
+// newGzipWriter compresses blocks of the archive in parallel with pgzip. The
+// output is a regular gzip stream, which any gzip reader can decompress.
+func newGzipWriter(w io.Writer, level int, threads int) (io.WriteCloser, error) {
+	/* -1 is pgzip.DefaultCompression */
+	writer, err := pgzip.NewWriterLevel(w, level)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := writer.SetConcurrency(gzipBlockSize, threads); err != nil {
+		return nil, err
+	}
+	return writer, nil
+}
+
+func newZstdWriter(w io.Writer, level int, threads int) (io.WriteCloser, error) {
+	encoderOptions := []zstd.EOption{zstd.WithEncoderConcurrency(threads)}
+	if level > 0 {
+		encoderOptions = append(encoderOptions, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+	}
+	return zstd.NewWriter(w, encoderOptions...)
+}
+
+// lz4Levels maps levels 1-9 to lz4's, which are slower and compress better
+// than its default.
+var lz4Levels = []lz4.CompressionLevel{lz4.Level1, lz4.Level2, lz4.Level3, lz4.Level4, lz4.Level5, lz4.Level6, lz4.Level7, lz4.Level8, lz4.Level9}
+
+// newLz4Writer trades compression for speed, for storage on the local
+// network where gzip takes longer than the transfer.
+func newLz4Writer(w io.Writer, level int, threads int) (io.WriteCloser, error) {
+	writerOptions := []lz4.Option{lz4.ConcurrencyOption(threads)}
+	if level > len(lz4Levels) {
+		return nil, fmt.Errorf("invalid lz4 level %d, use 1-%d", level, len(lz4Levels))
+	}
+	if level > 0 {
+		writerOptions = append(writerOptions, lz4.CompressionLevelOption(lz4Levels[level-1]))
+	}
+
+	writer := lz4.NewWriter(w)
+	if err := writer.Apply(writerOptions...); err != nil {
+		return nil, err
+	}
+	return writer, nil
+}
+
+// archiveCodec returns the codec selected with --compression, or none for
+// --compression-level=0.
+func archiveCodec() codec {
+	if options.CompressionLevel == 0 {
+		return codecs["none"]
+	}
+	if options.CompressionLevel < -1 {
+		terminate("--compression-level must be -1 or above", ERR_WRONG_USAGE)
+	}
+
+	selected, ok := codecs[options.Compression]
+	if !ok {
+		var names []string
+		for name := range codecs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		terminate(fmt.Sprintf("Unknown compression %q, use one of: %s", options.Compression, strings.Join(names, ", ")), ERR_WRONG_USAGE)
+	}
+
+	return selected
+}
+
+// compress wraps w in the codec selected with --compression.
+func compress(w io.Writer) (io.WriteCloser, error) {
+	return archiveCodec().NewWriter(w, options.CompressionLevel, compressThreads())
+}
+
+// compressThreads returns --compress-threads, or the number of CPUs when it
+// isn't set.
+func compressThreads() int {
+	if options.CompressThreads < 0 {
+		terminate("--compress-threads must be at least 1", ERR_WRONG_USAGE)
+	}
+	if options.CompressThreads == 0 {
+		return runtime.NumCPU()
+	}
+	return options.CompressThreads
+}
+
+// decompress detects the compression of an archive from its first bytes.
+func decompress(reader io.Reader) (io.ReadCloser, error) {
+	buffered := bufio.NewReader(reader)
+
+	magic, err := buffered.Peek(tarMagicOffset + len(tarMagic))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	switch {
+	case len(magic) > tarMagicOffset && bytes.HasPrefix(magic[tarMagicOffset:], tarMagic):
+		return io.NopCloser(buffered), nil
+	case bytes.HasPrefix(magic, gzipMagic):
+		return gzip.NewReader(buffered)
+	case bytes.HasPrefix(magic, zstdMagic):
+		decoder, err := zstd.NewReader(buffered)
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	case bytes.HasPrefix(magic, lz4Magic):
+		return io.NopCloser(lz4.NewReader(buffered)), nil
+	}
+
+	return nil, fmt.Errorf("unknown archive format")
+}
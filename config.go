@@ -0,0 +1,151 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+const configFileName = ".bundle_cache.yml"
+
+// configKeyEnv holds the key of encrypted config values, 32 bytes encoded as
+// base64, e.g. from openssl rand -base64 32.
+const configKeyEnv = "BUNDLE_CACHE_CONFIG_KEY"
+
+// encryptedPrefix marks config values encrypted with bundle_cache encrypt.
+const encryptedPrefix = "enc:"
+
+// configArgs reads the project config file and returns its settings as
+// command line arguments. Keys are the long option names, so the file
+// supports exactly the options the command line does.
+func configArgs() []string {
+	path := options.Config
+	if len(path) == 0 {
+		dir := options.Path
+		if len(dir) == 0 {
+			dir = "."
+		}
+
+		path = filepath.Join(dir, configFileName)
+		if found, _ := fileExists(path); !found {
+			return nil
+		}
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		terminate(fmt.Sprintf("Unable to read config file: %s", err), ERR_FILE_ACCESS)
+	}
+
+	var values map[string]interface{}
+	if err := yaml.Unmarshal(data, &values); err != nil {
+		terminate(fmt.Sprintf("Invalid config file %s: %s", path, err), ERR_WRONG_USAGE)
+	}
+
+	var names []string
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var args []string
+	for _, name := range names {
+		switch value := values[name].(type) {
+		case nil:
+		case bool:
+			if value {
+				args = append(args, "--"+name)
+			}
+		case []interface{}:
+			for _, item := range value {
+				args = append(args, fmt.Sprintf("--%s=%s", name, configValue(name, item)))
+			}
+		case map[interface{}]interface{}:
+			terminate(fmt.Sprintf("Invalid config file %s: %s must not be a map", path, name), ERR_WRONG_USAGE)
+		default:
+			args = append(args, fmt.Sprintf("--%s=%s", name, configValue(name, value)))
+		}
+	}
+
+	return args
+}
+
+// configValue formats a config value as an argument, decrypting encrypted
+// ones.
+func configValue(name string, value interface{}) string {
+	text := fmt.Sprintf("%v", value)
+	if !strings.HasPrefix(text, encryptedPrefix) {
+		return text
+	}
+
+	aead := configCipher()
+	data, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(text, encryptedPrefix))
+	if err != nil || len(data) < aead.NonceSize() {
+		terminate(fmt.Sprintf("Invalid encrypted value of %s in the config file", name), ERR_WRONG_USAGE)
+	}
+
+	plain, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], nil)
+	if err != nil {
+		terminate(fmt.Sprintf("Unable to decrypt %s in the config file, check %s", name, configKeyEnv), ERR_NO_CREDENTIALS)
+	}
+
+	return string(plain)
+}
+
+// configCipher returns AES-256-GCM with the key from configKeyEnv.
+func configCipher() cipher.AEAD {
+	encoded := os.Getenv(configKeyEnv)
+	if len(encoded) == 0 {
+		terminate(fmt.Sprintf("Please provide %s to decrypt the config file", configKeyEnv), ERR_NO_CREDENTIALS)
+	}
+
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil || len(key) != 32 {
+		terminate(fmt.Sprintf("%s must be 32 bytes encoded as base64", configKeyEnv), ERR_WRONG_USAGE)
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		terminate(fmt.Sprintf("Invalid %s: %s", configKeyEnv, err), ERR_WRONG_USAGE)
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		terminate(fmt.Sprintf("Invalid %s: %s", configKeyEnv, err), ERR_WRONG_USAGE)
+	}
+
+	return aead
+}
+
+// encryptValue reads a secret from stdin and prints it encrypted, to be put
+// into the config file in its place.
+func encryptValue() {
+	data, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		terminate(fmt.Sprintf("Unable to read value: %s", err), ERR_FILE_ACCESS)
+	}
+
+	secret := strings.TrimRight(string(data), "\r\n")
+	if len(secret) == 0 {
+		terminate("Please provide the value to encrypt on stdin", ERR_WRONG_USAGE)
+	}
+
+	aead := configCipher()
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		terminate(fmt.Sprintf("Unable to encrypt value: %s", err), 1)
+	}
+
+	sealed := aead.Seal(nonce, nonce, []byte(secret), nil)
+	fmt.Println(encryptedPrefix + base64.StdEncoding.EncodeToString(sealed))
+	os.Exit(ERR_OK)
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Experimental --delta mode: a manifest of file hashes is stored next to
+// every archive. Uploads compare the bundle with the manifest of the last
+// full archive of the project and, when little changed, only archive the
+// changed files. Downloads restore the full archive and apply the delta on
+// top. Deltas always apply to a full archive, so restoring never takes more
+// than two archives.
+
+// deltaMaxRatio is the share of the bundle above which a full archive is
+// uploaded instead of a delta, which also becomes the base of later deltas.
+const deltaMaxRatio = 0.5
+
+type deltaFile struct {
+	Hash string `json:"hash"`
+	Size int64  `json:"size"`
+	Dir  bool   `json:"dir,omitempty"`
+}
+
+type deltaManifest struct {
+	// Base is the key of the full archive a delta applies to, empty for
+	// full archives.
+	Base  string               `json:"base,omitempty"`
+	Files map[string]deltaFile `json:"files"`
+}
+
+func deltaManifestKey(key string) string {
+	return fmt.Sprintf("%s.manifest.json", strings.TrimSuffix(key, options.ArchiveExt))
+}
+
+// deltaLatestKey names the object holding the key of the last full archive,
+// which is the archive key with its checksum replaced by "latest".
+func deltaLatestKey() string {
+	key := strings.Replace(options.ArchiveKey, options.Checksum, "latest", 1)
+	return fmt.Sprintf("%s.json", strings.TrimSuffix(key, options.ArchiveExt))
+}
+
+// fileHashes hashes every entry below root by its path relative to root,
+// with up to workers files hashed at once.
+func fileHashes(root string, workers int) (map[string]deltaFile, error) {
+	files := make(map[string]deltaFile)
+	var names []string
+
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, _ := filepath.Rel(root, path)
+		if rel == "." {
+			return nil
+		}
+
+		if isExcluded(filepath.ToSlash(rel)) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		/* Files below a directory are listed themselves */
+		if info.IsDir() {
+			files[filepath.ToSlash(rel)] = deltaFile{Hash: info.Mode().String(), Dir: true}
+			return nil
+		}
+
+		files[filepath.ToSlash(rel)] = deltaFile{Size: info.Size()}
+		names = append(names, filepath.ToSlash(rel))
+		return nil
+	})
+	if err != nil {
+		return files, err
+	}
+
+	hashes, err := hashFiles(names, workers, func(name string) (string, error) {
+		return contentHash(filepath.Join(root, filepath.FromSlash(name)), nil)
+	})
+	for name, hash := range hashes {
+		file := files[name]
+		file.Hash = hash
+		files[name] = file
+	}
+
+	return files, err
+}
+
+func fetchDeltaManifest(backend Backend, key string) (*deltaManifest, error) {
+	body, err := backend.Get(deltaManifestKey(key))
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	var manifest deltaManifest
+	if err := json.NewDecoder(body).Decode(&manifest); err != nil {
+		return nil, fmt.Errorf("invalid manifest: %s", err)
+	}
+
+	return &manifest, nil
+}
+
+// deltaBase returns the key and manifest of the last full archive, or false
+// if there is none to compare with.
+func deltaBase(backend Backend) (string, *deltaManifest, bool) {
+	body, err := backend.Get(deltaLatestKey())
+	if err != nil {
+		return "", nil, false
+	}
+	latest, err := ioutil.ReadAll(body)
+	body.Close()
+	if err != nil {
+		return "", nil, false
+	}
+
+	key := strings.TrimSpace(string(latest))
+	manifest, err := fetchDeltaManifest(backend, key)
+	if err != nil || len(manifest.Base) > 0 {
+		return "", nil, false
+	}
+
+	return key, manifest, true
+}
+
+// changedFiles returns the files of current that base lacks or has with
+// other contents, and their total size.
+func changedFiles(base map[string]deltaFile, current map[string]deltaFile) (map[string]bool, int64) {
+	changed := make(map[string]bool)
+	var size int64
+
+	for name, file := range current {
+		if base[name] != file {
+			changed[name] = true
+			size += file.Size
+		}
+	}
+
+	return changed, size
+}
+
+func putJSON(backend Backend, key string, value interface{}) error {
+	body, _ := json.Marshal(value)
+	return backend.Put(key, bytes.NewReader(body), int64(len(body)))
+}
+
+func uploadDelta(backend Backend) {
+	fmt.Println("Hashing bundle...")
+	files, err := fileHashes(options.TargetPath, hashWorkers())
+	if err != nil {
+		terminate(fmt.Sprintf("Unable to hash bundle: %s", err), ERR_FILE_ACCESS)
+	}
+
+	var total int64
+	for _, file := range files {
+		total += file.Size
+	}
+
+	manifest := deltaManifest{Files: files}
+	changed := map[string]bool{}
+
+	if baseKey, base, ok := deltaBase(backend); ok {
+		var size int64
+		changed, size = changedFiles(base.Files, files)
+
+		if float64(size) <= deltaMaxRatio*float64(total) {
+			fmt.Printf("Archiving %d changed files against %s...\n", len(changed), baseKey)
+			manifest.Base = baseKey
+		}
+	}
+
+	if len(manifest.Base) == 0 {
+		fmt.Println("Archiving...")
+		err = createArchive(options.ArchivePath, options.TargetPaths)
+	} else {
+		err = writeArchive(options.ArchivePath, func(archive *tar.Writer) error {
+			return addChangedFiles(archive, options.TargetPath, changed)
+		})
+	}
+	if err != nil {
+		terminate(fmt.Sprintf("Failed to make archive: %s", err), 1)
+	}
+
+	/* The manifest goes first, so no archive is found without one */
+	if err := putJSON(backend, deltaManifestKey(options.ArchiveKey), manifest); err != nil {
+		terminate(fmt.Sprintf("Failed to upload manifest: %s", err), ERR_UPLOAD)
+	}
+
+	file, err := os.Open(options.ArchivePath)
+	if err != nil {
+		terminate(fmt.Sprintf("Unable to open archive: %s", err), ERR_FILE_ACCESS)
+	}
+	defer file.Close()
+	info, _ := file.Stat()
+
+	fmt.Println("Uploading bundle...")
+	if err := backend.Put(options.ArchiveKey, file, info.Size()); err != nil {
+		terminate(fmt.Sprintf("Failed to upload bundle: %s", err), ERR_UPLOAD)
+	}
+	metrics.Bytes = info.Size()
+
+	sum, err := fileChecksum(options.ArchivePath)
+	if err != nil {
+		terminate(fmt.Sprintf("Unable to read archive: %s", err), ERR_FILE_ACCESS)
+	}
+	if err := putChecksum(backend, options.ArchiveKey, sum); err != nil {
+		terminate(fmt.Sprintf("Failed to upload checksum: %s", err), ERR_UPLOAD)
+	}
+
+	if len(manifest.Base) == 0 {
+		latest := strings.NewReader(options.ArchiveKey)
+		if err := backend.Put(deltaLatestKey(), latest, latest.Size()); err != nil {
+			terminate(fmt.Sprintf("Failed to upload latest archive key: %s", err), ERR_UPLOAD)
+		}
+	}
+}
+
+// addChangedFiles archives the changed files below root and every
+// directory, so empty directories and their modes are kept.
+func addChangedFiles(archive *tar.Writer, root string, changed map[string]bool) error {
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, _ := filepath.Rel(root, path)
+		if rel == "." {
+			return addTarEntry(archive, ".", path, info)
+		}
+
+		rel = filepath.ToSlash(rel)
+		if info.IsDir() && isExcluded(rel) {
+			return filepath.SkipDir
+		}
+		if !info.IsDir() && !changed[rel] {
+			return nil
+		}
+
+		return addTarEntry(archive, "./"+rel, path, info)
+	})
+}
+
+// pruneDelta removes the files of a restored base archive that the delta
+// deletes or replaces. Directories are only removed when they are gone, as
+// their unchanged contents aren't in the delta. Names are checked like
+// archive entries, as the manifest comes from storage too.
+func pruneDelta(root string, base *deltaManifest, manifest *deltaManifest) error {
+	for name, file := range base.Files {
+		current, ok := manifest.Files[name]
+		if ok && (current == file || current.Dir && file.Dir) {
+			continue
+		}
+
+		if clean := path.Clean(name); clean == "." || clean == "/" {
+			return fmt.Errorf("invalid path in manifest: %q", name)
+		}
+
+		target, err := resolveEntryPath(root, filepath.FromSlash(name))
+		if err != nil {
+			return err
+		}
+		if err := checkParents(root, target); err != nil {
+			return err
+		}
+
+		if err := os.RemoveAll(target); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func extractKey(backend Backend, key string, root string, dirs *[]extractedDir) error {
+	body, err := getVerified(backend, key)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	if err := extractEntries(countingReader{body, &metrics.Bytes}, root, dirs); err != nil {
+		return err
+	}
+	return body.verify()
+}
+
+// downloadDelta restores key, applying it to its base archive when it is a
+// delta. Archives without a manifest are restored as they are.
+func downloadDelta(backend Backend, key string) bool {
+	manifest, err := fetchDeltaManifest(backend, key)
+	if err != nil || len(manifest.Base) == 0 {
+		return streamArchive(backend, key)
+	}
+
+	base, err := fetchDeltaManifest(backend, manifest.Base)
+	if err != nil {
+		fmt.Println("Unable to fetch base manifest:", err)
+		return false
+	}
+
+	staging, ok := createStaging(options.RestorePath)
+	if !ok {
+		return false
+	}
+
+	/* The delta holds every directory, so only its modes are restored */
+	var baseDirs, dirs []extractedDir
+
+	fmt.Println("Restoring base archive...", manifest.Base)
+	if err := extractKey(backend, manifest.Base, staging, &baseDirs); err != nil {
+		fmt.Println("Unable to restore base archive:", err)
+		os.RemoveAll(staging)
+		checkCorruption(err)
+		return false
+	}
+
+	if err := pruneDelta(staging, base, manifest); err != nil {
+		fmt.Println("Unable to apply delta:", err)
+		os.RemoveAll(staging)
+		return false
+	}
+
+	fmt.Println("Applying delta...")
+	if err := extractKey(backend, key, staging, &dirs); err != nil {
+		fmt.Println("Unable to apply delta:", err)
+		os.RemoveAll(staging)
+		checkCorruption(err)
+		return false
+	}
+
+	if err := restoreDirs(staging, dirs); err != nil {
+		fmt.Println("Unable to apply delta:", err)
+		removeTree(staging)
+		return false
+	}
+
+	return commitStaging(staging, options.RestorePath)
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFileHashesIndependentOfWorkers(t *testing.T) {
+	root := writeTree(t, 200, 1024)
+
+	sequential, err := fileHashes(root, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parallel, err := fileHashes(root, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(sequential, parallel) {
+		t.Error("manifest depends on the number of workers")
+	}
+	if len(sequential) != 300 {
+		t.Errorf("got %d entries, want 300", len(sequential))
+	}
+	for name, file := range sequential {
+		if len(file.Hash) == 0 {
+			t.Errorf("%s has no hash", name)
+		}
+	}
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// ignorePattern is a line of .dockerignore.
+type ignorePattern struct {
+	pattern *regexp.Regexp
+	negate  bool
+}
+
+// globPattern converts a .dockerignore pattern to a regular expression.
+// Besides filepath.Match syntax, ** matches any number of directories.
+func globPattern(glob string) (*regexp.Regexp, error) {
+	var expr strings.Builder
+	expr.WriteString("^")
+
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			if strings.HasPrefix(glob[i:], "**/") {
+				expr.WriteString("(.*/)?")
+				i += 2
+			} else if strings.HasPrefix(glob[i:], "**") {
+				expr.WriteString(".*")
+				i++
+			} else {
+				expr.WriteString("[^/]*")
+			}
+		case '?':
+			expr.WriteString("[^/]")
+		case '[':
+			end := strings.IndexByte(glob[i:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated character class in %q", glob)
+			}
+			class := glob[i+1 : i+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			expr.WriteString("[" + class + "]")
+			i += end
+		case '\\':
+			if i+1 < len(glob) {
+				i++
+			}
+			expr.WriteString(regexp.QuoteMeta(string(glob[i])))
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+
+	expr.WriteString("$")
+	return regexp.Compile(expr.String())
+}
+
+// readDockerignore parses the .dockerignore of the build context. A missing
+// file ignores nothing.
+func readDockerignore(context string) ([]ignorePattern, error) {
+	file, err := os.Open(filepath.Join(context, ".dockerignore"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var patterns []ignorePattern
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		negate := strings.HasPrefix(line, "!")
+		line = strings.TrimPrefix(line, "!")
+		line = strings.TrimPrefix(path.Clean("/"+strings.TrimSpace(line)), "/")
+
+		pattern, err := globPattern(line)
+		if err != nil {
+			return nil, err
+		}
+		patterns = append(patterns, ignorePattern{pattern, negate})
+	}
+
+	return patterns, scanner.Err()
+}
+
+// dockerIgnored reports whether Docker leaves rel out of the build context.
+// A pattern matching a directory excludes everything below it, and the last
+// matching pattern wins, so later ! lines can include files again.
+func dockerIgnored(patterns []ignorePattern, rel string) bool {
+	ignored := false
+
+	for _, p := range patterns {
+		for parent := rel; parent != "."; parent = path.Dir(parent) {
+			if p.pattern.MatchString(parent) {
+				ignored = !p.negate
+				break
+			}
+		}
+	}
+
+	return ignored
+}
+
+// contextHash hashes the files Docker sends as build context.
+func contextHash(context string) (string, error) {
+	patterns, err := readDockerignore(context)
+	if err != nil {
+		return "", fmt.Errorf("unable to read .dockerignore: %s", err)
+	}
+
+	var negations bool
+	for _, p := range patterns {
+		negations = negations || p.negate
+	}
+
+	return contentHash(context, func(rel string, dir bool) bool {
+		/* Files below an ignored directory may be included again */
+		if dir && negations {
+			return false
+		}
+		return dockerIgnored(patterns, rel)
+	})
+}
+
+// setDockerOptions keys the archive on the Dockerfile and build context
+// instead of a lockfile.
+func setDockerOptions() {
+	context := options.Path
+	if len(options.DockerContext) > 0 {
+		context = projectPath(options.DockerContext)
+	}
+
+	options.LockFilePath = filepath.Join(context, "Dockerfile")
+	if len(options.Dockerfile) > 0 {
+		options.LockFilePath = projectPath(options.Dockerfile)
+	}
+
+	options.KeyFilePaths = []string{options.LockFilePath}
+	for _, name := range options.KeyFile {
+		options.KeyFilePaths = append(options.KeyFilePaths, projectPath(name))
+	}
+
+	hash, err := contextHash(context)
+	if err != nil {
+		terminate(fmt.Sprintf("Unable to hash build context: %s", err), ERR_FILE_ACCESS)
+	}
+	options.ContextHash = hash
+
+	if len(options.Image) > 0 && options.Format == "zip" {
+		terminate("--format=zip is not supported with --image", ERR_WRONG_USAGE)
+	}
+
+	/* Archives hold the images they were saved with, whatever their order */
+	images := append([]string(nil), options.Image...)
+	sort.Strings(images)
+	options.ImageNames = strings.Join(images, "\x00")
+
+	if len(options.Image) == 0 {
+		if len(options.TargetDir) == 0 {
+			terminate("Please provide --image or --target-dir", ERR_WRONG_USAGE)
+		}
+		setTargetOptions(options.TargetDir, defaultMarker)
+	}
+}
+
+func imageArgs() string {
+	var images []string
+	for _, image := range options.Image {
+		images = append(images, shellQuote(image))
+	}
+	return strings.Join(images, " ")
+}
+
+// saveImages writes the output of docker save, compressed, to path.
+func saveImages(path string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	compressed, err := compress(file)
+	if err != nil {
+		return err
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.Command("docker", append([]string{"save"}, options.Image...)...)
+	cmd.Stdout = compressed
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	if err := compressed.Close(); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// loadImages feeds the archive at path to docker load.
+func loadImages(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	decompressed, err := decompress(file)
+	if err != nil {
+		return err
+	}
+	defer decompressed.Close()
+
+	var stderr bytes.Buffer
+	cmd := exec.Command("docker", "load")
+	cmd.Stdin = decompressed
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// dockerUpload saves the images with docker save and uploads the tarball,
+// unless storage has it already. Without --image the directories, e.g. a
+// buildx local cache export, are uploaded like a bundle.
+func dockerUpload(backend Backend) {
+	if len(options.Image) == 0 {
+		upload(backend)
+	}
+
+	exists, err := backend.Exists(options.ArchiveKey)
+	if err != nil {
+		terminate(fmt.Sprintf("Unable to look up images: %s", err), ERR_UPLOAD)
+	}
+	if exists {
+		metrics.Hit = true
+		terminate("Your images are cached, skipping.", ERR_OK)
+	}
+
+	fmt.Println("Saving images...")
+	if err := saveImages(options.ArchivePath); err != nil {
+		os.Remove(options.ArchivePath)
+		terminate(fmt.Sprintf("Failed to save images: %s", err), ERR_NO_BUNDLE)
+	}
+
+	uploadArchive(backend)
+}
+
+// dockerDownload loads the cached images with docker load, unless they
+// exist locally already.
+func dockerDownload(backend Backend) {
+	if len(options.Image) == 0 {
+		download(backend)
+	}
+
+	if _, err := sh(fmt.Sprintf("docker image inspect %s", imageArgs())); err == nil {
+		metrics.Hit = true
+		terminate("Images already exist, skipping.", ERR_OK)
+	}
+
+	key, found := lookupArchiveKey(backend)
+	if !found {
+		terminate("No cached images found.", ERR_CACHE_MISS)
+	}
+
+	file, err := os.Create(options.ArchivePath)
+	if err != nil {
+		terminate(fmt.Sprintf("Unable to create archive: %s", err), ERR_FILE_ACCESS)
+	}
+
+	fmt.Println("Downloading images...", key)
+	startProgress("Downloaded", 0)
+	metrics.Bytes, err = downloadFile(backend, key, file)
+	finishProgress()
+	file.Close()
+	if err != nil {
+		os.Remove(options.ArchivePath)
+		terminate(fmt.Sprintf("Failed to download images: %s", err), ERR_DOWNLOAD)
+	}
+
+	if err := verifyChecksum(backend, key, options.ArchivePath); err != nil {
+		os.Remove(options.ArchivePath)
+		terminate(fmt.Sprintf("Downloaded images are corrupt: %s", err), ERR_CHECKSUM)
+	}
+
+	fmt.Println("Loading images...")
+	err = loadImages(options.ArchivePath)
+	os.Remove(options.ArchivePath)
+	if err != nil {
+		terminate(fmt.Sprintf("Failed to load images: %s", err), ERR_EXTRACT)
+	}
+
+	metrics.Hit = true
+
+	fmt.Println("Done")
+	exit(0)
+}
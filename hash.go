@@ -0,0 +1,58 @@
+package main
+
+import (
+	"runtime"
+	"sync"
+)
+
+// Bundles with tens of thousands of files take long to hash one file at a
+// time, so per-file hashes are computed by a pool of workers.
+
+// maxHashWorkers bounds the files hashed at once, past which the disk
+// rather than the CPUs is the limit.
+const maxHashWorkers = 16
+
+func hashWorkers() int {
+	if workers := runtime.NumCPU(); workers < maxHashWorkers {
+		return workers
+	}
+	return maxHashWorkers
+}
+
+// hashFiles calls hash for every name with up to workers at once and
+// returns the hashes by name, so the order workers finish in doesn't change
+// the result. The first error is returned.
+func hashFiles(names []string, workers int, hash func(name string) (string, error)) (map[string]string, error) {
+	hashes := make(map[string]string, len(names))
+
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	var firstErr error
+	queue := make(chan string)
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for name := range queue {
+				sum, err := hash(name)
+
+				mutex.Lock()
+				if err != nil && firstErr == nil {
+					firstErr = err
+				}
+				hashes[name] = sum
+				mutex.Unlock()
+			}
+		}()
+	}
+
+	for _, name := range names {
+		queue <- name
+	}
+	close(queue)
+	wg.Wait()
+
+	return hashes, firstErr
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// writeTree creates count files of size bytes, spread over directories like
+// the gems of a bundle.
+func writeTree(t testing.TB, count int, size int) string {
+	t.Helper()
+
+	root := t.TempDir()
+	for i := 0; i < count; i++ {
+		dir := filepath.Join(root, fmt.Sprintf("gem-%d", i%50), "lib")
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		contents := make([]byte, size)
+		for j := range contents {
+			contents[j] = byte(i + j)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, fmt.Sprintf("file-%d.rb", i)), contents, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return root
+}
+
+// treeFiles lists the regular files below root.
+func treeFiles(t testing.TB, root string) []string {
+	t.Helper()
+
+	var files []string
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			files = append(files, path)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return files
+}
+
+func sha256File(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(data)), nil
+}
+
+func TestHashFilesIndependentOfWorkers(t *testing.T) {
+	files := treeFiles(t, writeTree(t, 200, 1024))
+
+	sequential, err := hashFiles(files, 1, sha256File)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parallel, err := hashFiles(files, 8, sha256File)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(sequential, parallel) {
+		t.Error("hashes depend on the number of workers")
+	}
+	if len(sequential) != 200 {
+		t.Errorf("got %d hashes, want 200", len(sequential))
+	}
+}
+
+func TestHashFilesReturnsError(t *testing.T) {
+	if _, err := hashFiles([]string{filepath.Join(t.TempDir(), "missing")}, 4, sha256File); err == nil {
+		t.Error("expected an error for a missing file")
+	}
+}
+
+func BenchmarkHashFiles(b *testing.B) {
+	files := treeFiles(b, writeTree(b, 2000, 32<<10))
+
+	for _, workers := range []int{1, 4, maxHashWorkers} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := hashFiles(files, workers, sha256File); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
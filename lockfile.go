@@ -0,0 +1,390 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// lockfileKind describes a package manager: the lockfile the checksum is
+// taken from, the manifest it is generated from and the directories cached.
+type lockfileKind struct {
+	Lockfile string
+	Manifest string
+	// Targets returns the directories to cache, relative to --path unless
+	// absolute. The first one holds the cache marker.
+	Targets func() ([]string, error)
+	// Lock is the command that updates the lockfile from the manifest.
+	Lock string
+	// Marker is the file written into the restored directory. Bundler keeps
+	// the historical .cache, which is a directory in node_modules.
+	Marker string
+	// Normalize, if set, strips parts of the lockfile that change without
+	// the installed dependencies changing before it is hashed.
+	Normalize func([]byte) ([]byte, error)
+	// Runtime, if set, returns the language version installed dependencies
+	// are built against, which becomes part of the archive name.
+	Runtime func() (string, error)
+}
+
+var lockfileKinds = []lockfileKind{
+	{Lockfile: "Gemfile.lock", Manifest: "Gemfile", Targets: dirs(".bundle"), Lock: "bundle lock", Marker: ".cache", Runtime: rubyRuntime},
+	{Lockfile: "package-lock.json", Manifest: "package.json", Targets: dirs("node_modules"), Lock: "npm install"},
+	{Lockfile: "yarn.lock", Manifest: "package.json", Targets: dirs("node_modules"), Lock: "yarn install"},
+	{Lockfile: "pnpm-lock.yaml", Manifest: "package.json", Targets: dirs("node_modules"), Lock: "pnpm install"},
+	{Lockfile: "Pipfile.lock", Manifest: "Pipfile", Targets: dirs(".venv"), Lock: "pipenv lock"},
+	{Lockfile: "poetry.lock", Manifest: "pyproject.toml", Targets: dirs(".venv"), Lock: "poetry lock"},
+	{Lockfile: "requirements.txt", Targets: dirs(".venv")},
+	{Lockfile: "composer.lock", Manifest: "composer.json", Targets: dirs("vendor"), Lock: "composer update --lock", Normalize: normalizeComposerLock},
+	{Lockfile: "go.sum", Manifest: "go.mod", Targets: goModCache, Lock: "go mod tidy"},
+	{Lockfile: "Cargo.lock", Manifest: "Cargo.toml", Targets: cargoTargets, Lock: "cargo generate-lockfile"},
+	{Lockfile: "gradle.lockfile", Targets: gradleCaches, Lock: "gradle dependencies --write-locks"},
+	{Lockfile: "build.gradle.kts", Targets: gradleCaches},
+	{Lockfile: "build.gradle", Targets: gradleCaches},
+	{Lockfile: "pom.xml", Targets: mavenRepository},
+	{Lockfile: "Podfile.lock", Manifest: "Podfile", Targets: dirs("Pods"), Lock: "pod install"},
+	{Lockfile: "mix.lock", Manifest: "mix.exs", Targets: mixTargets, Lock: "mix deps.get"},
+}
+
+// defaultMarker is the cache marker of every package manager but Bundler.
+const defaultMarker = ".bundle_cache"
+
+func dirs(targets ...string) func() ([]string, error) {
+	return func() ([]string, error) {
+		return targets, nil
+	}
+}
+
+// goModCache asks go for the module cache, which is shared by all projects.
+func goModCache() ([]string, error) {
+	out, err := sh(fmt.Sprintf("cd %s && go env GOMODCACHE", shellQuote(options.Path)))
+	if err != nil {
+		return nil, fmt.Errorf("unable to run `go env GOMODCACHE`: %s", strings.TrimSpace(out))
+	}
+
+	return []string{strings.TrimSpace(out)}, nil
+}
+
+// toolHome returns the directory in the environment variable env, or name
+// in the home directory.
+func toolHome(env string, name string) (string, error) {
+	if dir := os.Getenv(env); len(dir) > 0 {
+		return dir, nil
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(home, name), nil
+}
+
+// envDir returns the directory in the environment variable env, or name.
+func envDir(env string, name string) string {
+	if dir := os.Getenv(env); len(dir) > 0 {
+		return dir
+	}
+	return name
+}
+
+// cargoTargets caches the build directory, which holds the compiled
+// dependencies, and the registry of downloaded crates in $CARGO_HOME.
+func cargoTargets() ([]string, error) {
+	home, err := toolHome("CARGO_HOME", ".cargo")
+	if err != nil {
+		return nil, err
+	}
+
+	registry := filepath.Join(home, "registry")
+	if options.DepsOnly {
+		return []string{registry}, nil
+	}
+
+	return []string{envDir("CARGO_TARGET_DIR", "target"), registry}, nil
+}
+
+// mixTargets caches the fetched dependencies and the build directory, which
+// holds them compiled for each MIX_ENV.
+func mixTargets() ([]string, error) {
+	deps := envDir("MIX_DEPS_PATH", "deps")
+	if options.DepsOnly {
+		return []string{deps}, nil
+	}
+
+	return []string{deps, envDir("MIX_BUILD_ROOT", "_build")}, nil
+}
+
+// gradleCaches caches downloaded dependencies in $GRADLE_USER_HOME.
+func gradleCaches() ([]string, error) {
+	home, err := toolHome("GRADLE_USER_HOME", ".gradle")
+	if err != nil {
+		return nil, err
+	}
+
+	return []string{filepath.Join(home, "caches")}, nil
+}
+
+// mavenRepository caches the local repository, which Maven keeps in ~/.m2
+// regardless of where it is installed.
+func mavenRepository() ([]string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil, err
+	}
+
+	return []string{filepath.Join(home, ".m2", "repository")}, nil
+}
+
+// lockfiles maps the path of each lockfile in use to its kind.
+var lockfiles map[string]lockfileKind
+
+// lockfileRuntime is the Runtime function of the lockfile in use.
+var lockfileRuntime func() (string, error)
+
+var rubyVersionPattern = regexp.MustCompile(`^(?:ruby[- ])?(\d+\.\d+)`)
+var bundledWithPattern = regexp.MustCompile(`(?m)^BUNDLED WITH\r?\n\s+(\S+)`)
+
+// rubyRuntime returns the Ruby version that gems with native extensions are
+// compiled for, taken from .ruby-version next to the lockfile or from the
+// ruby in PATH. Only the major and minor version matter for the ABI. With
+// --bundler-version the version the lockfile was bundled with is added.
+func rubyRuntime() (string, error) {
+	version, err := ioutil.ReadFile(filepath.Join(filepath.Dir(options.LockFilePath), ".ruby-version"))
+	if err != nil {
+		out, err := sh(fmt.Sprintf("cd %s && ruby -v", shellQuote(options.Path)))
+		if err != nil {
+			return "", fmt.Errorf("unable to run `ruby -v`: %s", strings.TrimSpace(out))
+		}
+		version = []byte(out)
+	}
+
+	/* Other engines, e.g. jruby-9.4.5.0, are kept as they are */
+	name := strings.TrimSpace(strings.SplitN(string(version), "\n", 2)[0])
+	if match := rubyVersionPattern.FindStringSubmatch(name); match != nil {
+		name = "ruby" + match[1]
+	}
+
+	if options.BundlerVersion {
+		lockfile, err := ioutil.ReadFile(options.LockFilePath)
+		if err != nil {
+			return "", err
+		}
+
+		if match := bundledWithPattern.FindSubmatch(lockfile); match != nil {
+			name = fmt.Sprintf("%s-bundler%s", name, match[1])
+		}
+	}
+
+	return unsafeScopeChars.ReplaceAllString(name, "-"), nil
+}
+
+var bundledWithSection = regexp.MustCompile(`(?m)^BUNDLED WITH\n(?:[ \t].*(?:\n|$))*`)
+
+// normalizeLockfile converts line endings to \n and drops the BUNDLED WITH
+// section of Gemfile.lock, which changes with every Bundler release without
+// the locked gems changing.
+func normalizeLockfile(data []byte) []byte {
+	data = bytes.Replace(data, []byte("\r\n"), []byte("\n"), -1)
+	data = bundledWithSection.ReplaceAll(data, nil)
+
+	return append(bytes.TrimRight(data, "\n"), '\n')
+}
+
+// normalizeComposerLock drops content-hash, which changes with any edit of
+// composer.json such as reordering plugins, and plugin-api-version, which
+// depends on the Composer version that wrote the file. Re-encoding also
+// sorts the keys.
+func normalizeComposerLock(data []byte) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	var lock map[string]interface{}
+	if err := decoder.Decode(&lock); err != nil {
+		return nil, err
+	}
+
+	delete(lock, "content-hash")
+	delete(lock, "plugin-api-version")
+
+	return json.Marshal(lock)
+}
+
+// detectLockfile returns the first known lockfile present in dir.
+func detectLockfile(dir string) (lockfileKind, bool) {
+	for _, kind := range lockfileKinds {
+		if found, _ := fileExists(filepath.Join(dir, kind.Lockfile)); found {
+			return kind, true
+		}
+	}
+
+	return lockfileKind{}, false
+}
+
+func findLockfileKind(name string) (lockfileKind, bool) {
+	for _, kind := range lockfileKinds {
+		if kind.Lockfile == name {
+			return kind, true
+		}
+	}
+
+	return lockfileKind{}, false
+}
+
+// projectPath resolves name relative to --path unless it is absolute.
+func projectPath(name string) string {
+	if filepath.IsAbs(name) {
+		return name
+	}
+	return filepath.Join(options.Path, name)
+}
+
+// setTargetOptions resolves the directories to cache, the first of which
+// holds the cache marker.
+func setTargetOptions(targets []string, marker string) {
+	options.TargetPaths = nil
+	for _, target := range targets {
+		options.TargetPaths = append(options.TargetPaths, projectPath(target))
+	}
+	options.TargetPath = options.TargetPaths[0]
+
+	options.MarkerName = marker
+	options.CacheFilePath = filepath.Join(options.TargetPath, options.MarkerName)
+}
+
+// autoDetect returns every known lockfile in dir with the directories it
+// caches. Lockfiles whose directories are cached already, such as yarn.lock
+// next to package-lock.json, and those whose directories can't be found,
+// such as go.sum without go installed, are skipped.
+func autoDetect(dir string) ([]lockfileKind, []string) {
+	var kinds []lockfileKind
+	var targets []string
+	cached := make(map[string]bool)
+
+	for _, kind := range lockfileKinds {
+		if found, _ := fileExists(filepath.Join(dir, kind.Lockfile)); !found {
+			continue
+		}
+
+		dirs, err := kind.Targets()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: skipping %s, %s\n", kind.Lockfile, err)
+			continue
+		}
+
+		var added bool
+		for _, target := range dirs {
+			if path := projectPath(target); !cached[path] {
+				cached[path] = true
+				targets = append(targets, target)
+				added = true
+			}
+		}
+
+		if added {
+			kinds = append(kinds, kind)
+		}
+	}
+
+	return kinds, targets
+}
+
+// setLockfileOptions picks the lockfile from --lockfile or by looking for a
+// known one in --path, defaulting to Gemfile.lock, and the directories to
+// cache from --target-dir or the package manager. With --auto every known
+// lockfile in --path is used, the first one found taking the place of the
+// single lockfile.
+func setLockfileOptions() {
+	var kinds []lockfileKind
+	var targets []string
+
+	switch {
+	case len(options.Lockfile) > 0:
+		kind, _ := findLockfileKind(filepath.Base(options.Lockfile))
+		kinds = []lockfileKind{kind}
+		options.LockFilePath = projectPath(options.Lockfile)
+	case options.Auto:
+		kinds, targets = autoDetect(options.Path)
+		if len(kinds) == 0 {
+			terminate(fmt.Sprintf("No known lockfile found in %s", options.Path), ERR_NO_GEMLOCK)
+		}
+		options.LockFilePath = projectPath(kinds[0].Lockfile)
+	default:
+		kind, found := detectLockfile(options.Path)
+		if !found {
+			kind = lockfileKinds[0]
+		}
+		kinds = []lockfileKind{kind}
+		options.LockFilePath = projectPath(kind.Lockfile)
+	}
+
+	lockfiles = make(map[string]lockfileKind)
+	lockfiles[options.LockFilePath] = kinds[0]
+	for _, kind := range kinds[1:] {
+		lockfiles[projectPath(kind.Lockfile)] = kind
+	}
+
+	if options.Auto && len(options.Lockfile) == 0 {
+		var names []string
+		for _, kind := range kinds {
+			names = append(names, kind.Lockfile)
+		}
+		fmt.Fprintln(notices, "Detected", strings.Join(names, ", "))
+	}
+
+	options.KeyFilePaths = []string{options.LockFilePath}
+	for _, kind := range kinds[1:] {
+		options.KeyFilePaths = append(options.KeyFilePaths, projectPath(kind.Lockfile))
+	}
+
+	/* The command can take over the key entirely, e.g. with cat */
+	if len(options.KeyCmd) > 0 && len(options.KeyFile) == 0 {
+		options.KeyFilePaths = nil
+	}
+
+	if len(options.KeyFile) > 0 {
+		options.KeyFilePaths = nil
+		seen := make(map[string]bool)
+
+		for _, name := range options.KeyFile {
+			path := projectPath(name)
+			if !seen[path] {
+				seen[path] = true
+				options.KeyFilePaths = append(options.KeyFilePaths, path)
+			}
+		}
+	}
+
+	kind := kinds[0]
+
+	if len(options.TargetDir) > 0 {
+		targets = options.TargetDir
+	}
+	if len(targets) == 0 && kind.Targets != nil {
+		var err error
+		if targets, err = kind.Targets(); err != nil {
+			terminate(fmt.Sprintf("Unable to find the directories to cache: %s", err), ERR_WRONG_USAGE)
+		}
+	}
+	if len(targets) == 0 {
+		terminate(fmt.Sprintf("Please provide --target-dir for %s", options.LockFilePath), ERR_WRONG_USAGE)
+	}
+
+	marker := kind.Marker
+	if len(marker) == 0 {
+		marker = defaultMarker
+	}
+	setTargetOptions(targets, marker)
+
+	options.LockCommand = kind.Lock
+	lockfileRuntime = kind.Runtime
+
+	if len(kind.Manifest) > 0 {
+		options.ManifestPath = filepath.Join(filepath.Dir(options.LockFilePath), kind.Manifest)
+	}
+}
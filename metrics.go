@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// metrics collected during a run, reported on exit when --metrics-file or
+// --pushgateway is set.
+var metrics struct {
+	Action  string
+	Started time.Time
+	Hit     bool
+	Bytes   int64
+}
+
+type countingReader struct {
+	reader io.Reader
+	count  *int64
+}
+
+func (r countingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	*r.count += int64(n)
+	return n, err
+}
+
+// countingWriter adds the bytes written to count, which may be shared by
+// archives written at the same time.
+type countingWriter struct {
+	writer io.Writer
+	count  *int64
+}
+
+func (w countingWriter) Write(p []byte) (int, error) {
+	n, err := w.writer.Write(p)
+	atomic.AddInt64(w.count, int64(n))
+	return n, err
+}
+
+func formatMetrics() string {
+	var out bytes.Buffer
+
+	hit := 0
+	if metrics.Hit {
+		hit = 1
+	}
+
+	write := func(name string, help string, value string) {
+		fmt.Fprintf(&out, "# HELP %s %s\n", name, help)
+		fmt.Fprintf(&out, "# TYPE %s gauge\n", name)
+		fmt.Fprintf(&out, "%s{action=%q} %s\n", name, metrics.Action, value)
+	}
+
+	write("bundle_cache_hit", "Whether the bundle was found in cache.", fmt.Sprint(hit))
+	write("bundle_cache_bytes", "Size of the transferred archive in bytes.", fmt.Sprint(metrics.Bytes))
+	write("bundle_cache_duration_seconds", "Duration of the run in seconds.",
+		fmt.Sprintf("%.3f", time.Since(metrics.Started).Seconds()))
+
+	return out.String()
+}
+
+func pushMetrics(url string, body string) error {
+	url = fmt.Sprintf("%s/metrics/job/bundle_cache/action/%s", strings.TrimSuffix(url, "/"), metrics.Action)
+
+	resp, err := http.Post(url, "text/plain; version=0.0.4", strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("pushgateway responded with %s", resp.Status)
+	}
+
+	return nil
+}
+
+func reportMetrics() error {
+	if len(options.MetricsFile) == 0 && len(options.Pushgateway) == 0 {
+		return nil
+	}
+
+	body := formatMetrics()
+
+	if len(options.MetricsFile) > 0 {
+		if err := ioutil.WriteFile(options.MetricsFile, []byte(body), 0644); err != nil {
+			return err
+		}
+	}
+
+	if len(options.Pushgateway) > 0 {
+		return pushMetrics(options.Pushgateway, body)
+	}
+
+	return nil
+}
+
+func exit(exit_code int) {
+	if err := reportMetrics(); err != nil {
+		fmt.Fprintln(os.Stderr, "Unable to report metrics:", err)
+	}
+
+	os.Exit(exit_code)
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// projectEnv is set for the runs of the individual projects, which inherit
+// --projects from the command line or config file and must not recurse.
+const projectEnv = "BUNDLE_CACHE_PROJECT"
+
+// findProjects expands the --projects globs relative to --path into the
+// sorted list of matching directories.
+func findProjects() []string {
+	seen := make(map[string]bool)
+	var projects []string
+
+	for _, pattern := range options.Projects {
+		matches, err := filepath.Glob(projectPath(pattern))
+		if err != nil {
+			terminate(fmt.Sprintf("Invalid --projects pattern %q: %s", pattern, err), ERR_WRONG_USAGE)
+		}
+
+		for _, match := range matches {
+			if info, err := os.Stat(match); err != nil || !info.IsDir() || seen[match] {
+				continue
+			}
+			seen[match] = true
+			projects = append(projects, match)
+		}
+	}
+
+	sort.Strings(projects)
+	return projects
+}
+
+// prefixWriter writes complete lines prefixed with the project name, so the
+// output of projects running in parallel doesn't interleave mid-line.
+type prefixWriter struct {
+	mutex  *sync.Mutex
+	out    io.Writer
+	prefix string
+}
+
+func (w prefixWriter) copy(reader io.Reader) {
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		w.mutex.Lock()
+		fmt.Fprintf(w.out, "%s%s\n", w.prefix, scanner.Text())
+		w.mutex.Unlock()
+	}
+}
+
+// runProject runs a single project by running bundle_cache again with the
+// same arguments and --path pointing at the project.
+func runProject(executable string, dir string, name string, shared []string, prefix string, mutex *sync.Mutex) int {
+	args := append(append(append([]string{}, os.Args[1:]...), shared...), "--path="+dir)
+
+	/* A shared prefix would give projects with equal lockfiles one key */
+	if len(prefix) > 0 {
+		args = append(args, fmt.Sprintf("--prefix=%s_%s", prefix, unsafeScopeChars.ReplaceAllString(name, "-")))
+	}
+
+	cmd := exec.Command(executable, args...)
+	cmd.Env = append(os.Environ(), projectEnv+"="+name)
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		fmt.Printf("[%s] Unable to run: %s\n", name, err)
+		return 1
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		fmt.Printf("[%s] Unable to run: %s\n", name, err)
+		return 1
+	}
+
+	if err := cmd.Start(); err != nil {
+		fmt.Printf("[%s] Unable to run: %s\n", name, err)
+		return 1
+	}
+
+	var output sync.WaitGroup
+	output.Add(2)
+	go func() {
+		prefixWriter{mutex, os.Stdout, fmt.Sprintf("[%s] ", name)}.copy(stdout)
+		output.Done()
+	}()
+	go func() {
+		prefixWriter{mutex, os.Stderr, fmt.Sprintf("[%s] ", name)}.copy(stderr)
+		output.Done()
+	}()
+	output.Wait()
+
+	if err := cmd.Wait(); err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return exitErr.ExitCode()
+		}
+		return 1
+	}
+
+	return ERR_OK
+}
+
+// runProjects runs the action for every project matched by --projects, up
+// to --jobs at a time, and exits with the status of the first project in the
+// list that failed.
+func runProjects() {
+	if len(options.MetricsFile) > 0 || len(options.Pushgateway) > 0 {
+		terminate("Metrics are not supported with --projects", ERR_WRONG_USAGE)
+	}
+	if options.Jobs < 1 {
+		terminate("--jobs must be at least 1", ERR_WRONG_USAGE)
+	}
+
+	if len(options.Path) == 0 {
+		options.Path, _ = os.Getwd()
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		executable = os.Args[0]
+	}
+
+	/* The config file of the repository applies to every project */
+	var shared []string
+	if config := filepath.Join(options.Path, configFileName); len(options.Config) == 0 && checkFileExists(config) {
+		shared = append(shared, "--config="+config)
+	}
+
+	prefix := options.Prefix
+	if len(prefix) == 0 && options.PrefixFromGit {
+		prefix = gitRepoName(options.Path)
+	}
+
+	projects := findProjects()
+	if len(projects) == 0 {
+		terminate("No projects match --projects", ERR_WRONG_USAGE)
+	}
+
+	codes := make([]int, len(projects))
+	names := make([]string, len(projects))
+	slots := make(chan struct{}, options.Jobs)
+
+	var mutex sync.Mutex
+	var wait sync.WaitGroup
+
+	for i, dir := range projects {
+		name, err := filepath.Rel(options.Path, dir)
+		if err != nil {
+			name = filepath.Base(dir)
+		}
+		names[i] = filepath.ToSlash(name)
+
+		wait.Add(1)
+		go func(i int, dir string) {
+			defer wait.Done()
+
+			slots <- struct{}{}
+			codes[i] = runProject(executable, dir, names[i], shared, prefix, &mutex)
+			<-slots
+		}(i, dir)
+	}
+	wait.Wait()
+
+	status := ERR_OK
+	failed := 0
+	for i, code := range codes {
+		if code == ERR_OK {
+			continue
+		}
+
+		fmt.Printf("%s failed with exit status %d\n", names[i], code)
+		failed++
+		if status == ERR_OK {
+			status = code
+		}
+	}
+
+	fmt.Printf("%d of %d projects done\n", len(projects)-failed, len(projects))
+	exit(status)
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// detectPlatform identifies what native code in a bundle was built for: the
+// OS, the architecture and on Linux the C library, e.g. linux-amd64-glibc2.35
+// or linux-arm64-musl. Gems built against glibc fail to load on musl, and
+// against a newer glibc on an older one.
+func detectPlatform() string {
+	platform := fmt.Sprintf("%s-%s", runtime.GOOS, runtime.GOARCH)
+
+	if runtime.GOOS == "linux" {
+		if libc := detectLibc(); len(libc) > 0 {
+			platform = fmt.Sprintf("%s-%s", platform, libc)
+		}
+	}
+
+	return platform
+}
+
+func detectLibc() string {
+	/* Prints e.g. "glibc 2.35", musl's getconf doesn't know the variable */
+	if out, err := sh("getconf GNU_LIBC_VERSION 2>/dev/null"); err == nil {
+		if fields := strings.Fields(out); len(fields) == 2 {
+			return fields[0] + fields[1]
+		}
+	}
+
+	if matches, _ := filepath.Glob("/lib/ld-musl-*"); len(matches) > 0 {
+		return "musl"
+	}
+
+	return ""
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// progressInterval is how often progress is printed as plain lines, which
+// end up in CI logs.
+const progressInterval = 10 * time.Second
+
+// progressBarInterval is how often the progress bar is redrawn.
+const progressBarInterval = 200 * time.Millisecond
+
+const progressBarWidth = 30
+
+// transferProgress tracks the bytes sent and received over HTTP while a
+// transfer runs. The total is only known for some transfers, others show
+// bytes and throughput without a percentage and ETA.
+type transferProgress struct {
+	label   string
+	total   int64
+	done    int64
+	started time.Time
+	bar     bool
+	stop    chan struct{}
+	wait    sync.WaitGroup
+}
+
+var activeProgress atomic.Pointer[transferProgress]
+
+// progressMode returns --progress, resolving auto to a bar when notices go
+// to a terminal and plain lines elsewhere.
+func progressMode() string {
+	switch options.Progress {
+	case "", "auto":
+		if file, ok := notices.(*os.File); ok {
+			if info, err := file.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 {
+				return "bar"
+			}
+		}
+		return "plain"
+	case "bar", "plain", "none":
+		return options.Progress
+	}
+
+	terminate(fmt.Sprintf("Unknown progress %q, use auto, bar, plain or none", options.Progress), ERR_WRONG_USAGE)
+	return ""
+}
+
+// startProgress reports the progress of a transfer until finishProgress.
+// A total of 0 means unknown.
+func startProgress(label string, total int64) {
+	mode := progressMode()
+	if mode == "none" {
+		return
+	}
+
+	p := &transferProgress{label: label, total: total, started: time.Now(), bar: mode == "bar", stop: make(chan struct{})}
+	activeProgress.Store(p)
+
+	interval := progressInterval
+	if p.bar {
+		interval = progressBarInterval
+	}
+
+	p.wait.Add(1)
+	go func() {
+		defer p.wait.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				p.print()
+			case <-p.stop:
+				return
+			}
+		}
+	}()
+}
+
+// setProgressTotal sets the size of the running transfer once it is known.
+func setProgressTotal(total int64) {
+	if p := activeProgress.Load(); p != nil {
+		atomic.CompareAndSwapInt64(&p.total, 0, total)
+	}
+}
+
+func addProgress(n int) {
+	if p := activeProgress.Load(); p != nil {
+		atomic.AddInt64(&p.done, int64(n))
+	}
+}
+
+func finishProgress() {
+	p := activeProgress.Swap(nil)
+	if p == nil {
+		return
+	}
+
+	close(p.stop)
+	p.wait.Wait()
+
+	/* A transfer done before the first line needs none */
+	if p.bar || time.Since(p.started) >= progressInterval {
+		p.print()
+	}
+	if p.bar {
+		fmt.Fprintln(notices)
+	}
+}
+
+func (p *transferProgress) print() {
+	done := atomic.LoadInt64(&p.done)
+	total := atomic.LoadInt64(&p.total)
+	elapsed := time.Since(p.started)
+
+	var rate float64
+	if elapsed > 0 {
+		rate = float64(done) / elapsed.Seconds()
+	}
+
+	line := fmt.Sprintf("%s %s", p.label, formatSize(done))
+	if total > 0 {
+		/* Retried requests are counted twice */
+		if done > total {
+			done = total
+		}
+		percent := float64(done) / float64(total) * 100
+		line = fmt.Sprintf("%s %s of %s (%.0f%%)", p.label, formatSize(done), formatSize(total), percent)
+
+		if p.bar {
+			filled := int(percent / 100 * progressBarWidth)
+			line = fmt.Sprintf("[%s%s] %s", strings.Repeat("=", filled), strings.Repeat(" ", progressBarWidth-filled), line)
+		}
+	}
+
+	line = fmt.Sprintf("%s, %s/s", line, formatSize(int64(rate)))
+	if total > 0 && rate > 0 && done < total {
+		eta := time.Duration(float64(total-done) / rate * float64(time.Second))
+		line = fmt.Sprintf("%s, ETA %s", line, eta.Round(time.Second))
+	}
+
+	if p.bar {
+		/* Clears what is left of a longer previous line */
+		fmt.Fprintf(notices, "\r%s\033[K", line)
+	} else {
+		fmt.Fprintln(notices, line)
+	}
+}
+
+// formatSize formats bytes with a binary unit, e.g. 1.5 GB.
+func formatSize(bytes int64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+
+	size := float64(bytes)
+	unit := 0
+	for size >= 1024 && unit < len(units)-1 {
+		size /= 1024
+		unit++
+	}
+
+	if unit == 0 {
+		return fmt.Sprintf("%d B", bytes)
+	}
+	return fmt.Sprintf("%.1f %s", size, units[unit])
+}
+
+// progressTransport counts the bytes of request and response bodies.
+type progressTransport struct {
+	http.RoundTripper
+}
+
+type progressBody struct {
+	io.ReadCloser
+}
+
+func (b progressBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	addProgress(n)
+	return n, err
+}
+
+func (t progressTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil && req.Body != http.NoBody {
+		req = req.Clone(req.Context())
+		req.Body = progressBody{req.Body}
+	}
+
+	resp, err := t.RoundTripper.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	resp.Body = progressBody{resp.Body}
+	return resp, nil
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Experimental --split-by-dir mode: every top-level entry of the bundle is
+// archived into its own object keyed by its content hash, and an index
+// object lists the parts making up a bundle. Unchanged directories are
+// shared between lockfile versions and never uploaded twice.
+
+const splitConcurrency = 8
+
+type splitPart struct {
+	Name string `json:"name"`
+	Key  string `json:"key"`
+}
+
+type splitIndex struct {
+	Parts []splitPart `json:"parts"`
+}
+
+func splitIndexKey() string {
+	return fmt.Sprintf("%s.index.json", strings.TrimSuffix(options.ArchiveKey, options.ArchiveExt))
+}
+
+func splitPartKey(name string, hash string) string {
+	name = unsafeScopeChars.ReplaceAllString(name, "-")
+	return path.Join(path.Dir(options.ArchiveKey), options.Prefix+"_parts", fmt.Sprintf("%s_%s%s", name, hash, options.ArchiveExt))
+}
+
+func shellQuote(value string) string {
+	return fmt.Sprintf("'%s'", strings.Replace(value, "'", `'\''`, -1))
+}
+
+// contentHash hashes the names, modes and contents of everything under path.
+// Paths for which skip, if given, returns true are left out.
+func contentHash(root string, skip func(rel string, dir bool) bool) (string, error) {
+	h := sha1.New()
+
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, _ := filepath.Rel(root, path)
+		if skip != nil && rel != "." && skip(filepath.ToSlash(rel), info.IsDir()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		fmt.Fprintf(h, "%s\x00%s\x00", rel, info.Mode())
+
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			io.WriteString(h, link)
+		case info.Mode().IsRegular():
+			file, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+
+			if _, err := io.Copy(h, file); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	return fmt.Sprintf("%x", h.Sum(nil)), err
+}
+
+// forEachPart runs fn for every part with bounded concurrency and returns
+// the first error encountered.
+func forEachPart(parts []splitPart, fn func(splitPart) error) error {
+	return forEachIndex(len(parts), splitConcurrency, func(i int) error {
+		if err := fn(parts[i]); err != nil {
+			return fmt.Errorf("%s: %w", parts[i].Name, err)
+		}
+		return nil
+	})
+}
+
+func uploadPart(backend Backend, part splitPart) error {
+	if exists, _ := backend.Exists(part.Key); exists {
+		fmt.Println("Part unchanged:", part.Name)
+		return nil
+	}
+
+	archive, err := ioutil.TempFile("", "bundle_cache_part")
+	if err != nil {
+		return err
+	}
+	archive.Close()
+	defer os.Remove(archive.Name())
+
+	err = writeArchive(archive.Name(), func(tw *tar.Writer) error {
+		return addTree(tw, filepath.Join(options.TargetPath, part.Name), part.Name, part.Name)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to make archive: %s", err)
+	}
+
+	body, err := os.Open(archive.Name())
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	info, err := body.Stat()
+	if err != nil {
+		return err
+	}
+
+	sum, err := fileChecksum(archive.Name())
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Uploading part:", part.Name)
+	if err := backend.Put(part.Key, body, info.Size()); err != nil {
+		return err
+	}
+	return putChecksum(backend, part.Key, sum)
+}
+
+func uploadSplit(backend Backend) {
+	entries, err := ioutil.ReadDir(options.TargetPath)
+	if err != nil {
+		terminate(fmt.Sprintf("Unable to read bundle path: %s", err), ERR_FILE_ACCESS)
+	}
+
+	var index splitIndex
+	for _, entry := range entries {
+		if isExcluded(entry.Name()) {
+			continue
+		}
+
+		name := entry.Name()
+		hash, err := contentHash(filepath.Join(options.TargetPath, name), func(rel string, _ bool) bool {
+			return isExcluded(path.Join(name, rel))
+		})
+		if err != nil {
+			terminate(fmt.Sprintf("Unable to hash %s: %s", entry.Name(), err), 1)
+		}
+
+		index.Parts = append(index.Parts, splitPart{
+			Name: entry.Name(),
+			Key:  splitPartKey(entry.Name(), hash),
+		})
+	}
+
+	if err := forEachPart(index.Parts, func(part splitPart) error {
+		return uploadPart(backend, part)
+	}); err != nil {
+		terminate(fmt.Sprintf("Failed to upload part %s", err), ERR_UPLOAD)
+	}
+
+	body, _ := json.Marshal(index)
+	err = backend.Put(splitIndexKey(), bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		terminate(fmt.Sprintf("Failed to upload index: %s", err), ERR_UPLOAD)
+	}
+}
+
+func fetchSplitIndex(backend Backend) splitIndex {
+	body, err := backend.Get(splitIndexKey())
+	if err != nil {
+		terminate(fmt.Sprintf("Unable to fetch archive index: %s", err), ERR_CACHE_MISS)
+	}
+	defer body.Close()
+
+	var index splitIndex
+	if err := json.NewDecoder(body).Decode(&index); err != nil {
+		terminate(fmt.Sprintf("Invalid archive index: %s", err), ERR_EXTRACT)
+	}
+
+	return index
+}
+
+func downloadSplit(backend Backend) bool {
+	index := fetchSplitIndex(backend)
+
+	staging, ok := createStaging(options.RestorePath)
+	if !ok {
+		return false
+	}
+
+	err := forEachPart(index.Parts, func(part splitPart) error {
+		body, err := getVerified(backend, part.Key)
+		if err != nil {
+			return err
+		}
+		defer body.Close()
+
+		fmt.Println("Extracting part:", part.Name)
+		if err := extractTar(body, staging); err != nil {
+			return err
+		}
+		return body.verify()
+	})
+	if err != nil {
+		fmt.Println("Unable to restore part", err)
+		removeTree(staging)
+		checkCorruption(err)
+		return false
+	}
+
+	return commitStaging(staging, options.RestorePath)
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Backend is where archives are stored. Keys are the computed archive keys,
+// so every backend shares the same naming and skip logic.
+type Backend interface {
+	// Put stores size bytes read from body under key.
+	Put(key string, body io.ReadSeeker, size int64) error
+	// Get returns the contents stored under key.
+	Get(key string) (io.ReadCloser, error)
+	// Exists reports whether key is stored. Errors other than a missing
+	// key are returned.
+	Exists(key string) (bool, error)
+	// Delete removes key. Deleting a missing key is not an error.
+	Delete(key string) error
+	// List returns all stored keys starting with prefix.
+	List(prefix string) ([]string, error)
+}
+
+// streamUploader is implemented by backends that can store a body of unknown
+// size while it is being produced, so the archive needs no local copy.
+type streamUploader interface {
+	PutStream(key string, body io.Reader) error
+}
+
+// presigner is implemented by backends that can hand out time-limited URLs
+// to transfer a key without credentials.
+type presigner interface {
+	Presign(method string, key string, expiry time.Duration) (string, error)
+}
+
+// fileDownloader is implemented by backends that can download into a file
+// faster than a single sequential Get, e.g. with parallel ranged requests.
+type fileDownloader interface {
+	DownloadFile(key string, file *os.File) (int64, error)
+}
+
+func downloadFile(backend Backend, key string, file *os.File) (int64, error) {
+	if downloader, ok := backend.(fileDownloader); ok {
+		return downloader.DownloadFile(key, file)
+	}
+
+	body, err := backend.Get(key)
+	if err != nil {
+		return 0, err
+	}
+	defer body.Close()
+
+	return io.Copy(file, body)
+}
+
+// checksumKey names the object holding the SHA-256 of the archive at key.
+// It is stored next to the archive rather than as metadata, which not every
+// backend has and which streamed uploads only know once they are done.
+func checksumKey(key string) string {
+	return key + ".sha256"
+}
+
+func fileChecksum(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%x", hash.Sum(nil)), nil
+}
+
+func putChecksum(backend Backend, key string, sum string) error {
+	body := strings.NewReader(sum + "\n")
+	return backend.Put(checksumKey(key), body, body.Size())
+}
+
+// checksumError is a mismatch between an archive and its stored checksum.
+type checksumError struct {
+	actual   string
+	expected string
+}
+
+func (e *checksumError) Error() string {
+	return fmt.Sprintf("SHA-256 is %s, expected %s", e.actual, e.expected)
+}
+
+// fetchChecksum returns the checksum stored for the archive at key, or an
+// empty string for archives uploaded without one.
+func fetchChecksum(backend Backend, key string) (string, error) {
+	exists, err := backend.Exists(checksumKey(key))
+	if err != nil || !exists {
+		return "", err
+	}
+
+	body, err := backend.Get(checksumKey(key))
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+
+	expected, err := ioutil.ReadAll(body)
+	return strings.TrimSpace(string(expected)), err
+}
+
+// verifyChecksum compares the archive downloaded from key to path with the
+// checksum stored on upload. Archives uploaded without one pass.
+func verifyChecksum(backend Backend, key string, path string) error {
+	expected, err := fetchChecksum(backend, key)
+	if err != nil || len(expected) == 0 {
+		return err
+	}
+
+	actual, err := fileChecksum(path)
+	if err != nil {
+		return err
+	}
+
+	if actual != expected {
+		return &checksumError{actual, expected}
+	}
+	return nil
+}
+
+// verifiedBody hashes an archive while it is extracted, so archives that
+// never land on disk are checked against their stored checksum before the
+// staging directory they were extracted into is moved into place.
+type verifiedBody struct {
+	io.ReadCloser
+	hash     hash.Hash
+	expected string
+}
+
+func getVerified(backend Backend, key string) (*verifiedBody, error) {
+	expected, err := fetchChecksum(backend, key)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := backend.Get(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &verifiedBody{body, sha256.New(), expected}, nil
+}
+
+func (b *verifiedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.hash.Write(p[:n])
+	return n, err
+}
+
+// verify reads what the extractor left of the archive, such as the end of
+// the compressed stream, and compares the hash with the stored checksum.
+func (b *verifiedBody) verify() error {
+	if _, err := io.Copy(ioutil.Discard, b); err != nil {
+		return err
+	}
+
+	if actual := fmt.Sprintf("%x", b.hash.Sum(nil)); len(b.expected) > 0 && actual != b.expected {
+		return &checksumError{actual, b.expected}
+	}
+	return nil
+}
+
+// checkCorruption exits with ERR_CHECKSUM when err is a checksum mismatch.
+func checkCorruption(err error) {
+	var mismatch *checksumError
+	if errors.As(err, &mismatch) {
+		terminate(fmt.Sprintf("Downloaded archive is corrupt: %s", err), ERR_CHECKSUM)
+	}
+}
+
+// withLocalFile calls fn with the path of a file holding the contents of
+// body, spooling it to a temporary file when it is not a file already.
+func withLocalFile(body io.ReadSeeker, fn func(path string) error) error {
+	if file, ok := body.(*os.File); ok {
+		return fn(file.Name())
+	}
+
+	tmp, err := ioutil.TempFile("", "bundle_cache")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = io.Copy(tmp, body)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return fn(tmp.Name())
+}
+
+// tempFileReader removes the file it reads from once closed.
+type tempFileReader struct {
+	*os.File
+}
+
+func (r tempFileReader) Close() error {
+	err := r.File.Close()
+	os.Remove(r.File.Name())
+	return err
+}
+
+// fetchTempFile lets fn write into a temporary file and returns a reader
+// for it that cleans up after itself.
+func fetchTempFile(fn func(path string) error) (io.ReadCloser, error) {
+	tmp, err := ioutil.TempFile("", "bundle_cache")
+	if err != nil {
+		return nil, err
+	}
+	tmp.Close()
+
+	if err := fn(tmp.Name()); err != nil {
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+
+	file, err := os.Open(tmp.Name())
+	if err != nil {
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+
+	return tempFileReader{file}, nil
+}
+
+// storedKey maps a name listed by a backend that strips the leading slash
+// from keys back to the key form used by prefix.
+func storedKey(prefix string, name string) string {
+	if strings.HasPrefix(prefix, "/") {
+		return "/" + name
+	}
+	return name
+}
+
+// detectContentType sniffs the content type of body and rewinds it.
+func detectContentType(body io.ReadSeeker) string {
+	buffer := make([]byte, 512)
+	n, _ := io.ReadFull(body, buffer)
+	body.Seek(0, io.SeekStart)
+
+	return sniffContentType(buffer[:n])
+}
+
+// sniffContentType returns the content type of an archive starting with
+// buffer.
+func sniffContentType(buffer []byte) string {
+	n := len(buffer)
+
+	/* Not known to http.DetectContentType */
+	if bytes.HasPrefix(buffer[:n], zstdMagic) {
+		return "application/zstd"
+	}
+	if bytes.HasPrefix(buffer[:n], lz4Magic) {
+		return "application/x-lz4"
+	}
+	if n > tarMagicOffset && bytes.HasPrefix(buffer[tarMagicOffset:n], tarMagic) {
+		return "application/x-tar"
+	}
+
+	return http.DetectContentType(buffer[:n])
+}
+
+// transferContext is cancelled once --transfer-timeout runs out, failing
+// transfers still in progress.
+var transferContext = context.Background()
+
+var cancelTransfers context.CancelFunc = func() {}
+
+// startTransferTimeout starts the --transfer-timeout clock.
+func startTransferTimeout() {
+	if options.TransferTimeout > 0 {
+		transferContext, cancelTransfers = context.WithTimeout(context.Background(), options.TransferTimeout)
+	}
+}
+
+func newBackend() Backend {
+	parsed := options
+	backend := newMultipartBackend(newRetryBackend(newThrottledBackend(newStorageBackend())))
+
+	if len(options.FallbackStorage) > 0 {
+		backend = newChainBackend(backend, func() { options = parsed })
+	}
+
+	if len(options.LocalCache) > 0 {
+		return newTieredBackend(backend)
+	}
+
+	return backend
+}
+
+func newStorageBackend() Backend {
+	if len(options.BackendCmd) > 0 {
+		return newCmdBackend()
+	}
+
+	switch options.Storage {
+	case "s3":
+		return newS3Backend()
+	case "azure":
+		return newAzureBackend()
+	case "file":
+		return newFileBackend()
+	case "http":
+		if options.HTTPChunked {
+			return httpStreamBackend{newHTTPBackend().(*httpBackend)}
+		}
+		return newHTTPBackend()
+	case "sftp":
+		return newSFTPBackend()
+	case "rsync":
+		return newRsyncBackend()
+	case "artifactory":
+		return newArtifactoryBackend()
+	case "b2":
+		return newB2Backend()
+	case "oss":
+		return newOSSBackend()
+	case "r2":
+		return newR2Backend()
+	case "swift":
+		return newSwiftBackend()
+	case "redis":
+		return newRedisBackend()
+	case "ipfs":
+		return newIPFSBackend()
+	case "gdrive":
+		return newGDriveBackend()
+	case "onedrive":
+		return newOneDriveBackend()
+	}
+
+	terminate(fmt.Sprintf("Unknown storage: %s", options.Storage), ERR_WRONG_USAGE)
+	return nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+)
+
+// artifactoryBackend stores archives in an Artifactory repository. Uploads
+// try a checksum deploy first, so identical archives are deduplicated on the
+// server without being transferred again.
+type artifactoryBackend struct {
+	http *httpBackend
+	repo string
+}
+
+func newArtifactoryBackend() Backend {
+	if len(options.ArtifactoryRepo) == 0 {
+		terminate("Please provide Artifactory repository", ERR_WRONG_USAGE)
+	}
+
+	return &artifactoryBackend{
+		http: newHTTPBackend().(*httpBackend),
+		repo: options.ArtifactoryRepo,
+	}
+}
+
+// path lays archives out as <repo>/<prefix>/<archive>, unless a key
+// template decides the layout.
+func (b *artifactoryBackend) path(key string) string {
+	if keyTemplate != nil {
+		return path.Join(b.repo, key)
+	}
+
+	return path.Join(b.repo, options.Prefix, path.Base(key))
+}
+
+func (b *artifactoryBackend) properties() string {
+	return fmt.Sprintf(";bundle_cache.prefix=%s;bundle_cache.checksum=%s",
+		url.PathEscape(options.Prefix), url.PathEscape(options.Checksum))
+}
+
+func (b *artifactoryBackend) Put(key string, body io.ReadSeeker, size int64) error {
+	sha1Hash := sha1.New()
+	sha256Hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(sha1Hash, sha256Hash), body); err != nil {
+		return err
+	}
+	if _, err := body.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	target := b.path(key) + b.properties()
+	checksums := map[string]string{
+		"X-Checksum-Sha1":   fmt.Sprintf("%x", sha1Hash.Sum(nil)),
+		"X-Checksum-Sha256": fmt.Sprintf("%x", sha256Hash.Sum(nil)),
+	}
+
+	req, err := b.http.newRequest("PUT", target, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Checksum-Deploy", "true")
+	for name, value := range checksums {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := b.http.do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNotFound {
+		fmt.Println("Deployed by checksum, content already on server")
+		return nil
+	}
+
+	req, err = b.http.newRequest("PUT", target, body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	for name, value := range checksums {
+		req.Header.Set(name, value)
+	}
+
+	resp, err = b.http.do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("repository %s not found", b.repo)
+	}
+
+	return nil
+}
+
+func (b *artifactoryBackend) Get(key string) (io.ReadCloser, error) {
+	return b.http.Get(b.path(key))
+}
+
+func (b *artifactoryBackend) Exists(key string) (bool, error) {
+	return b.http.Exists(b.path(key))
+}
+
+func (b *artifactoryBackend) Delete(key string) error {
+	return b.http.Delete(b.path(key))
+}
+
+// List is not supported, as the repository layout drops the key directory.
+func (b *artifactoryBackend) List(prefix string) ([]string, error) {
+	return nil, errors.New("listing is not supported by artifactory storage")
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const azureAPIVersion = "2020-04-08"
+
+// azureBackend stores archives as block blobs using the Blob service REST
+// API, authenticating with either a shared key or a SAS token.
+type azureBackend struct {
+	account   string
+	key       []byte
+	sas       string
+	container string
+	client    *http.Client
+}
+
+func checkAzureCredentials() {
+	if len(options.AzureAccount) == 0 && envDefined("AZURE_STORAGE_ACCOUNT") {
+		options.AzureAccount = os.Getenv("AZURE_STORAGE_ACCOUNT")
+	}
+
+	if len(options.AzureKey) == 0 && envDefined("AZURE_STORAGE_KEY") {
+		options.AzureKey = os.Getenv("AZURE_STORAGE_KEY")
+	}
+
+	if len(options.AzureSAS) == 0 && envDefined("AZURE_STORAGE_SAS_TOKEN") {
+		options.AzureSAS = os.Getenv("AZURE_STORAGE_SAS_TOKEN")
+	}
+
+	if len(options.AzureContainer) == 0 && envDefined("AZURE_STORAGE_CONTAINER") {
+		options.AzureContainer = os.Getenv("AZURE_STORAGE_CONTAINER")
+	}
+
+	if len(options.AzureAccount) == 0 {
+		terminate("Please provide Azure storage account", ERR_NO_CREDENTIALS)
+	}
+
+	if len(options.AzureKey) == 0 && len(options.AzureSAS) == 0 {
+		terminate("Please provide Azure storage key or SAS token", ERR_NO_CREDENTIALS)
+	}
+
+	if len(options.AzureContainer) == 0 {
+		terminate("Please provide Azure container name", ERR_NO_CREDENTIALS)
+	}
+}
+
+func newAzureBackend() Backend {
+	checkAzureCredentials()
+
+	backend := &azureBackend{
+		account:   options.AzureAccount,
+		sas:       strings.TrimPrefix(options.AzureSAS, "?"),
+		container: options.AzureContainer,
+		client:    http.DefaultClient,
+	}
+
+	if len(options.AzureKey) > 0 {
+		key, err := base64.StdEncoding.DecodeString(options.AzureKey)
+		if err != nil {
+			terminate("Azure storage key is not valid base64", ERR_NO_CREDENTIALS)
+		}
+		backend.key = key
+	}
+
+	if needsCustomTransport() {
+		backend.client = newHTTPClient()
+	}
+
+	return backend
+}
+
+func (b *azureBackend) blobURL(key string) string {
+	blob := (&url.URL{Path: strings.TrimPrefix(key, "/")}).EscapedPath()
+	return fmt.Sprintf("https://%s.blob.core.windows.net/%s/%s", b.account, b.container, blob)
+}
+
+func (b *azureBackend) newRequest(method string, key string, body io.Reader) (*http.Request, error) {
+	return b.newURLRequest(method, b.blobURL(key), body)
+}
+
+func (b *azureBackend) newURLRequest(method string, target string, body io.Reader) (*http.Request, error) {
+	if len(b.key) == 0 {
+		separator := "?"
+		if strings.Contains(target, "?") {
+			separator = "&"
+		}
+		target = fmt.Sprintf("%s%s%s", target, separator, b.sas)
+	}
+
+	req, err := http.NewRequestWithContext(transferContext, method, target, body)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("x-ms-date", time.Now().UTC().Format(http.TimeFormat))
+	req.Header.Set("x-ms-version", azureAPIVersion)
+
+	return req, nil
+}
+
+// sign adds a SharedKey authorization header as described in
+// https://docs.microsoft.com/rest/api/storageservices/authorize-with-shared-key
+func (b *azureBackend) sign(req *http.Request) {
+	if len(b.key) == 0 {
+		return
+	}
+
+	length := ""
+	if req.ContentLength > 0 {
+		length = strconv.FormatInt(req.ContentLength, 10)
+	}
+
+	var msHeaders []string
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		if strings.HasPrefix(name, "x-ms-") {
+			msHeaders = append(msHeaders, fmt.Sprintf("%s:%s\n", name, strings.Join(values, ",")))
+		}
+	}
+	sort.Strings(msHeaders)
+
+	resource := fmt.Sprintf("/%s%s", b.account, req.URL.EscapedPath())
+	query := req.URL.Query()
+	var params []string
+	for name := range query {
+		params = append(params, name)
+	}
+	sort.Strings(params)
+	for _, name := range params {
+		resource += fmt.Sprintf("\n%s:%s", strings.ToLower(name), strings.Join(query[name], ","))
+	}
+
+	stringToSign := strings.Join([]string{
+		req.Method,
+		req.Header.Get("Content-Encoding"),
+		req.Header.Get("Content-Language"),
+		length,
+		req.Header.Get("Content-MD5"),
+		req.Header.Get("Content-Type"),
+		"", // Date, superseded by x-ms-date
+		req.Header.Get("If-Modified-Since"),
+		req.Header.Get("If-Match"),
+		req.Header.Get("If-None-Match"),
+		req.Header.Get("If-Unmodified-Since"),
+		req.Header.Get("Range"),
+		strings.Join(msHeaders, "") + resource,
+	}, "\n")
+
+	mac := hmac.New(sha256.New, b.key)
+	mac.Write([]byte(stringToSign))
+	signature := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+
+	req.Header.Set("Authorization", fmt.Sprintf("SharedKey %s:%s", b.account, signature))
+}
+
+func (b *azureBackend) do(req *http.Request) (*http.Response, error) {
+	b.sign(req)
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode >= 300 && resp.StatusCode != http.StatusNotFound {
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(message)))
+	}
+
+	return resp, nil
+}
+
+func (b *azureBackend) Put(key string, body io.ReadSeeker, size int64) error {
+	req, err := b.newRequest("PUT", key, body)
+	if err != nil {
+		return err
+	}
+
+	req.ContentLength = size
+	req.Header.Set("Content-Type", detectContentType(body))
+	req.Header.Set("x-ms-blob-type", "BlockBlob")
+
+	resp, err := b.do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("container %s not found", b.container)
+	}
+
+	return nil
+}
+
+func (b *azureBackend) Get(key string) (io.ReadCloser, error) {
+	req, err := b.newRequest("GET", key, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := b.do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, fmt.Errorf("blob %s not found", key)
+	}
+
+	return resp.Body, nil
+}
+
+func (b *azureBackend) Exists(key string) (bool, error) {
+	req, err := b.newRequest("HEAD", key, nil)
+	if err != nil {
+		return false, err
+	}
+
+	resp, err := b.do(req)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+
+	return resp.StatusCode != http.StatusNotFound, nil
+}
+
+func (b *azureBackend) Delete(key string) error {
+	req, err := b.newRequest("DELETE", key, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := b.do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	return nil
+}
+
+type azureBlobList struct {
+	Blobs []struct {
+		Name string `xml:"Name"`
+	} `xml:"Blobs>Blob"`
+	NextMarker string `xml:"NextMarker"`
+}
+
+// List pages through the container listing using the continuation marker.
+func (b *azureBackend) List(prefix string) ([]string, error) {
+	var keys []string
+	marker := ""
+
+	for {
+		query := url.Values{
+			"restype": {"container"},
+			"comp":    {"list"},
+			"prefix":  {strings.TrimPrefix(prefix, "/")},
+		}
+		if len(marker) > 0 {
+			query.Set("marker", marker)
+		}
+
+		target := fmt.Sprintf("https://%s.blob.core.windows.net/%s?%s", b.account, b.container, query.Encode())
+		req, err := b.newURLRequest("GET", target, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := b.do(req)
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode == http.StatusNotFound {
+			resp.Body.Close()
+			return nil, fmt.Errorf("container %s not found", b.container)
+		}
+
+		var list azureBlobList
+		err = xml.NewDecoder(resp.Body).Decode(&list)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, blob := range list.Blobs {
+			keys = append(keys, storedKey(prefix, blob.Name))
+		}
+
+		if len(list.NextMarker) == 0 {
+			return keys, nil
+		}
+		marker = list.NextMarker
+	}
+}
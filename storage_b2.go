@@ -0,0 +1,29 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// newB2Backend talks to Backblaze B2 through its S3 compatible API.
+// Application keys work as access keys and the endpoint follows from the
+// bucket region, e.g. us-west-004.
+func newB2Backend() Backend {
+	if len(options.AccessKey) == 0 && envDefined("B2_APPLICATION_KEY_ID") {
+		options.AccessKey = os.Getenv("B2_APPLICATION_KEY_ID")
+	}
+
+	if len(options.SecretKey) == 0 && envDefined("B2_APPLICATION_KEY") {
+		options.SecretKey = os.Getenv("B2_APPLICATION_KEY")
+	}
+
+	if len(options.Region) == 0 {
+		terminate("Please provide B2 bucket region, e.g. us-west-004", ERR_NO_CREDENTIALS)
+	}
+
+	if len(options.Endpoint) == 0 {
+		options.Endpoint = fmt.Sprintf("https://s3.%s.backblazeb2.com", options.Region)
+	}
+
+	return newS3Backend()
+}
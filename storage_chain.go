@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	flags "github.com/jessevdk/go-flags"
+)
+
+// chainBackend reads from an ordered list of backends, e.g. a regional
+// bucket followed by a global one and an HTTP mirror. Writes only go to the
+// first, primary backend.
+type chainBackend struct {
+	backends []Backend
+	names    []string
+}
+
+// newChainBackend adds a backend for every --fallback-storage. Each is
+// configured from the command line options, restored by reset from before
+// the primary backend filled in its defaults, overridden by the options in
+// the spec.
+func newChainBackend(primary Backend, reset func()) Backend {
+	chain := &chainBackend{backends: []Backend{primary}, names: []string{options.Storage}}
+	configured := options
+
+	for _, spec := range configured.FallbackStorage {
+		reset()
+		options.BackendCmd = ""
+
+		if _, err := flags.NewParser(&options, flags.None).ParseArgs(strings.Fields(spec)); err != nil {
+			terminate(fmt.Sprintf("Invalid fallback storage %q: %s", spec, err), ERR_WRONG_USAGE)
+		}
+
+		chain.backends = append(chain.backends, newMultipartBackend(newRetryBackend(newThrottledBackend(newStorageBackend()))))
+		chain.names = append(chain.names, options.Storage)
+	}
+
+	options = configured
+	return chain
+}
+
+// find returns the first backend holding key. Errors are reported and the
+// backend skipped.
+func (b *chainBackend) find(key string) (Backend, bool) {
+	for i, backend := range b.backends {
+		found, err := backend.Exists(key)
+		if err != nil {
+			fmt.Printf("Unable to check %s storage: %s\n", b.names[i], err)
+			continue
+		}
+
+		if found {
+			if i > 0 {
+				fmt.Printf("Found in fallback %s storage\n", b.names[i])
+			}
+			return backend, true
+		}
+	}
+
+	return nil, false
+}
+
+func (b *chainBackend) Put(key string, body io.ReadSeeker, size int64) error {
+	return b.backends[0].Put(key, body, size)
+}
+
+func (b *chainBackend) Get(key string) (io.ReadCloser, error) {
+	backend, found := b.find(key)
+	if !found {
+		return nil, fmt.Errorf("%s not found in any storage", key)
+	}
+
+	return backend.Get(key)
+}
+
+// DownloadFile keeps the fast path of the backend holding key.
+func (b *chainBackend) DownloadFile(key string, file *os.File) (int64, error) {
+	backend, found := b.find(key)
+	if !found {
+		return 0, fmt.Errorf("%s not found in any storage", key)
+	}
+
+	return downloadFile(backend, key, file)
+}
+
+func (b *chainBackend) Exists(key string) (bool, error) {
+	_, found := b.find(key)
+	return found, nil
+}
+
+func (b *chainBackend) Delete(key string) error {
+	return b.backends[0].Delete(key)
+}
+
+func (b *chainBackend) List(prefix string) ([]string, error) {
+	return b.backends[0].List(prefix)
+}
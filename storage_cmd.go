@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+)
+
+// cmdBackend delegates storage to an external command, so backends can be
+// added without rebuilding bundle_cache. The command is run once per
+// operation with a JSON request on stdin and must print a JSON response on
+// stdout. Archive contents are exchanged through local files rather than
+// the pipes:
+//
+//	{"op": "put", "key": "...", "file": "/tmp/...", "size": 123}
+//	{"op": "get", "key": "...", "file": "/tmp/..."}   write contents to file
+//	{"op": "exists", "key": "..."}                    reply {"exists": true}
+//	{"op": "delete", "key": "..."}
+//	{"op": "list", "prefix": "..."}                   reply {"keys": [...]}
+//
+// An empty response means success. Failures are reported as
+// {"error": "..."}, a non-zero exit status is treated as a failure too.
+type cmdBackend struct {
+	command string
+}
+
+type pluginRequest struct {
+	Op     string `json:"op"`
+	Key    string `json:"key,omitempty"`
+	Prefix string `json:"prefix,omitempty"`
+	File   string `json:"file,omitempty"`
+	Size   int64  `json:"size,omitempty"`
+}
+
+type pluginResponse struct {
+	Error  string   `json:"error"`
+	Exists bool     `json:"exists"`
+	Keys   []string `json:"keys"`
+}
+
+func newCmdBackend() Backend {
+	return &cmdBackend{command: options.BackendCmd}
+}
+
+func (b *cmdBackend) call(request pluginRequest) (*pluginResponse, error) {
+	payload, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+
+	var output bytes.Buffer
+
+	cmd := exec.CommandContext(transferContext, "bash", "-c", b.command)
+	cmd.Stdin = bytes.NewReader(payload)
+	cmd.Stdout = &output
+	cmd.Stderr = os.Stderr
+
+	runErr := cmd.Run()
+
+	var response pluginResponse
+	if output.Len() == 0 && runErr == nil {
+		return &response, nil
+	}
+
+	if err := json.Unmarshal(bytes.TrimSpace(output.Bytes()), &response); err != nil {
+		if runErr != nil {
+			return nil, fmt.Errorf("backend command failed: %s", runErr)
+		}
+		return nil, fmt.Errorf("invalid backend command response: %s", err)
+	}
+
+	if len(response.Error) > 0 {
+		return nil, errors.New(response.Error)
+	}
+
+	if runErr != nil {
+		return nil, fmt.Errorf("backend command failed: %s", runErr)
+	}
+
+	return &response, nil
+}
+
+// Put hands the plugin a file path.
+func (b *cmdBackend) Put(key string, body io.ReadSeeker, size int64) error {
+	return withLocalFile(body, func(path string) error {
+		_, err := b.call(pluginRequest{Op: "put", Key: key, File: path, Size: size})
+		return err
+	})
+}
+
+func (b *cmdBackend) Get(key string) (io.ReadCloser, error) {
+	return fetchTempFile(func(path string) error {
+		_, err := b.call(pluginRequest{Op: "get", Key: key, File: path})
+		return err
+	})
+}
+
+func (b *cmdBackend) Exists(key string) (bool, error) {
+	response, err := b.call(pluginRequest{Op: "exists", Key: key})
+	if err != nil {
+		return false, err
+	}
+
+	return response.Exists, nil
+}
+
+func (b *cmdBackend) Delete(key string) error {
+	_, err := b.call(pluginRequest{Op: "delete", Key: key})
+	return err
+}
+
+func (b *cmdBackend) List(prefix string) ([]string, error) {
+	response, err := b.call(pluginRequest{Op: "list", Prefix: prefix})
+	if err != nil {
+		return nil, err
+	}
+
+	return response.Keys, nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// fileBackend keeps archives in a local or network mounted directory.
+type fileBackend struct {
+	root string
+}
+
+func newFileBackend() Backend {
+	if len(options.CacheDir) == 0 {
+		terminate("Please provide cache directory", ERR_WRONG_USAGE)
+	}
+
+	if !checkFileExists(options.CacheDir) {
+		terminate(fmt.Sprintf("Cache directory %s does not exist", options.CacheDir), ERR_FILE_ACCESS)
+	}
+
+	return &fileBackend{root: options.CacheDir}
+}
+
+func (b *fileBackend) path(key string) string {
+	return filepath.Join(b.root, filepath.FromSlash(strings.TrimPrefix(key, "/")))
+}
+
+func (b *fileBackend) Put(key string, body io.ReadSeeker, size int64) error {
+	return b.PutStream(key, body)
+}
+
+// PutStream writes to a temporary file first and renames it into place, so
+// that concurrent readers on a shared volume never see a partial archive.
+func (b *fileBackend) PutStream(key string, body io.Reader) error {
+	path := b.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".bundle_cache")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = io.Copy(tmp, body)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+func (b *fileBackend) Get(key string) (io.ReadCloser, error) {
+	return os.Open(b.path(key))
+}
+
+func (b *fileBackend) Exists(key string) (bool, error) {
+	return fileExists(b.path(key))
+}
+
+func (b *fileBackend) Delete(key string) error {
+	err := os.Remove(b.path(key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (b *fileBackend) List(prefix string) ([]string, error) {
+	var keys []string
+
+	err := filepath.Walk(b.root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		/* Skip directories and uploads still in progress */
+		if info.IsDir() || strings.HasPrefix(info.Name(), ".bundle_cache") {
+			return nil
+		}
+
+		name, err := filepath.Rel(b.root, path)
+		if err != nil {
+			return err
+		}
+
+		key := storedKey(prefix, filepath.ToSlash(name))
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+
+	return keys, err
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"golang.org/x/oauth2/endpoints"
+)
+
+const gdriveAPI = "https://www.googleapis.com/drive/v3/files"
+const gdriveUploadAPI = "https://www.googleapis.com/upload/drive/v3/files"
+
+// gdriveBackend stores archives in the hidden application data folder of a
+// Google Drive, named by their key.
+type gdriveBackend struct {
+	client *http.Client
+}
+
+type gdriveFile struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type gdriveFileList struct {
+	Files         []gdriveFile `json:"files"`
+	NextPageToken string       `json:"nextPageToken"`
+}
+
+func newGDriveBackend() Backend {
+	client := newOAuthClient("gdrive", endpoints.Google, "https://www.googleapis.com/auth/drive.appdata")
+	return &gdriveBackend{client: client}
+}
+
+func (b *gdriveBackend) list(query string, pageToken string) (*gdriveFileList, error) {
+	params := url.Values{
+		"spaces":   {"appDataFolder"},
+		"fields":   {"nextPageToken,files(id,name)"},
+		"pageSize": {"1000"},
+	}
+	if len(query) > 0 {
+		params.Set("q", query)
+	}
+	if len(pageToken) > 0 {
+		params.Set("pageToken", pageToken)
+	}
+
+	req, err := http.NewRequestWithContext(transferContext, "GET", fmt.Sprintf("%s?%s", gdriveAPI, params.Encode()), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := doRequest(b.client, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var list gdriveFileList
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, err
+	}
+
+	return &list, nil
+}
+
+// find returns the id of the file named key, or an empty string.
+func (b *gdriveBackend) find(key string) (string, error) {
+	name := strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(key)
+
+	list, err := b.list(fmt.Sprintf("name = '%s' and trashed = false", name), "")
+	if err != nil {
+		return "", err
+	}
+
+	if len(list.Files) == 0 {
+		return "", nil
+	}
+
+	return list.Files[0].ID, nil
+}
+
+// Put uses a resumable upload session, which unlike a multipart upload has
+// no size limit. Existing files are updated in place.
+func (b *gdriveBackend) Put(key string, body io.ReadSeeker, size int64) error {
+	id, err := b.find(key)
+	if err != nil {
+		return err
+	}
+
+	method := "POST"
+	target := gdriveUploadAPI + "?uploadType=resumable"
+	metadata := map[string]interface{}{"name": key, "parents": []string{"appDataFolder"}}
+
+	if len(id) > 0 {
+		method = "PATCH"
+		target = fmt.Sprintf("%s/%s?uploadType=resumable", gdriveUploadAPI, id)
+		metadata = map[string]interface{}{}
+	}
+
+	payload, _ := json.Marshal(metadata)
+	req, err := http.NewRequestWithContext(transferContext, method, target, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	req.Header.Set("X-Upload-Content-Length", fmt.Sprint(size))
+
+	resp, err := doRequest(b.client, req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	session := resp.Header.Get("Location")
+	if len(session) == 0 {
+		return fmt.Errorf("no upload session returned: %s", resp.Status)
+	}
+
+	req, err = http.NewRequestWithContext(transferContext, "PUT", session, body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+
+	resp, err = doRequest(b.client, req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	return nil
+}
+
+func (b *gdriveBackend) Get(key string) (io.ReadCloser, error) {
+	id, err := b.find(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(id) == 0 {
+		return nil, fmt.Errorf("file %s not found", key)
+	}
+
+	req, err := http.NewRequestWithContext(transferContext, "GET", fmt.Sprintf("%s/%s?alt=media", gdriveAPI, id), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := doRequest(b.client, req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, fmt.Errorf("file %s not found", key)
+	}
+
+	return resp.Body, nil
+}
+
+func (b *gdriveBackend) Exists(key string) (bool, error) {
+	id, err := b.find(key)
+	return len(id) > 0, err
+}
+
+func (b *gdriveBackend) Delete(key string) error {
+	id, err := b.find(key)
+	if err != nil || len(id) == 0 {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(transferContext, "DELETE", fmt.Sprintf("%s/%s", gdriveAPI, id), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := doRequest(b.client, req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	return nil
+}
+
+// List fetches all names and filters them locally, Drive queries cannot
+// match a name prefix.
+func (b *gdriveBackend) List(prefix string) ([]string, error) {
+	var keys []string
+	pageToken := ""
+
+	for {
+		list, err := b.list("trashed = false", pageToken)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, file := range list.Files {
+			if strings.HasPrefix(file.Name, prefix) {
+				keys = append(keys, file.Name)
+			}
+		}
+
+		if len(list.NextPageToken) == 0 {
+			return keys, nil
+		}
+		pageToken = list.NextPageToken
+	}
+}
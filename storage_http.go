@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// encodingPeekSize is how much of a gzip-encoded response is decoded ahead
+// to tell whether the server compressed the archive or only labelled it.
+const encodingPeekSize = 64 << 10
+
+// httpBackend stores archives on a plain HTTP server supporting PUT and GET,
+// such as nginx with WebDAV or an Artifactory generic repository.
+// Downloads accept gzip content encoding, which is decoded here rather than
+// by the HTTP client, so archives stored as .tar.gz aren't unpacked by
+// servers labelling them with it.
+type httpBackend struct {
+	url      string
+	user     string
+	password string
+	token    string
+	headers  map[string]string
+	client   *http.Client
+}
+
+func newHTTPBackend() Backend {
+	if len(options.URL) == 0 {
+		terminate("Please provide storage URL", ERR_WRONG_USAGE)
+	}
+
+	if len(options.HTTPUser) == 0 && envDefined("BUNDLE_CACHE_HTTP_USER") {
+		options.HTTPUser = os.Getenv("BUNDLE_CACHE_HTTP_USER")
+	}
+
+	if len(options.HTTPPassword) == 0 && envDefined("BUNDLE_CACHE_HTTP_PASSWORD") {
+		options.HTTPPassword = os.Getenv("BUNDLE_CACHE_HTTP_PASSWORD")
+	}
+
+	if len(options.HTTPToken) == 0 && envDefined("BUNDLE_CACHE_HTTP_TOKEN") {
+		options.HTTPToken = os.Getenv("BUNDLE_CACHE_HTTP_TOKEN")
+	}
+
+	backend := &httpBackend{
+		url:      strings.TrimSuffix(options.URL, "/"),
+		user:     options.HTTPUser,
+		password: options.HTTPPassword,
+		token:    options.HTTPToken,
+		client:   http.DefaultClient,
+	}
+
+	if needsCustomTransport() {
+		backend.client = newHTTPClient()
+	}
+
+	return backend
+}
+
+func (b *httpBackend) newRequest(method string, key string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(transferContext, method, fmt.Sprintf("%s/%s", b.url, strings.TrimPrefix(key, "/")), body)
+	if err != nil {
+		return nil, err
+	}
+
+	b.authorize(req)
+	return req, nil
+}
+
+func (b *httpBackend) authorize(req *http.Request) {
+	if len(b.token) > 0 {
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", b.token))
+	} else if len(b.user) > 0 {
+		req.SetBasicAuth(b.user, b.password)
+	}
+
+	for name, value := range b.headers {
+		req.Header.Set(name, value)
+	}
+}
+
+func (b *httpBackend) do(req *http.Request) (*http.Response, error) {
+	return doRequest(b.client, req)
+}
+
+// statusError is an unexpected HTTP response status.
+type statusError struct {
+	code    int
+	message string
+}
+
+func (e *statusError) Error() string {
+	return e.message
+}
+
+// doRequest turns error statuses into errors with the start of the response
+// body. 404 is left for the caller to interpret.
+func doRequest(client *http.Client, req *http.Request) (*http.Response, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode >= 300 && resp.StatusCode != http.StatusNotFound {
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, &statusError{resp.StatusCode, fmt.Sprintf("%s: %s", resp.Status, strings.TrimSpace(string(message)))}
+	}
+
+	return resp, nil
+}
+
+func (b *httpBackend) Put(key string, body io.ReadSeeker, size int64) error {
+	req, err := b.newRequest("PUT", key, body)
+	if err != nil {
+		return err
+	}
+
+	req.ContentLength = size
+	req.Header.Set("Content-Type", detectContentType(body))
+
+	return b.put(req)
+}
+
+func (b *httpBackend) put(req *http.Request) error {
+	resp, err := b.do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("%s not found", req.URL)
+	}
+
+	return nil
+}
+
+func (b *httpBackend) Get(key string) (io.ReadCloser, error) {
+	req, err := b.newRequest("GET", key, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	/* Set explicitly, the client would otherwise decode gzip on its own */
+	req.Header.Set("Accept-Encoding", "gzip")
+
+	resp, err := b.do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s not found", req.URL)
+	}
+
+	if resp.ContentLength > 0 {
+		setProgressTotal(resp.ContentLength)
+	}
+
+	body, err := decodeBody(key, resp)
+	if err != nil {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s: %s", req.URL, err)
+	}
+	return body, nil
+}
+
+type decodedBody struct {
+	io.Reader
+	io.Closer
+}
+
+// decodeBody returns the stored contents of key from resp. Servers either
+// compress responses on the fly, or serve stored .gz files with gzip
+// encoding. The latter are kept as they are, which is told apart by the
+// decoded response not being gzip itself.
+func decodeBody(key string, resp *http.Response) (io.ReadCloser, error) {
+	switch encoding := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding"))); encoding {
+	case "", "identity":
+		return resp.Body, nil
+	case "gzip", "x-gzip":
+	default:
+		return nil, fmt.Errorf("unsupported content encoding %s", encoding)
+	}
+
+	buffered := bufio.NewReaderSize(resp.Body, encodingPeekSize)
+
+	if strings.HasSuffix(key, ".gz") || strings.HasSuffix(key, ".tgz") {
+		head, _ := buffered.Peek(encodingPeekSize)
+
+		magic := make([]byte, 2)
+		decoder, err := gzip.NewReader(bytes.NewReader(head))
+		if err == nil {
+			_, err = io.ReadFull(decoder, magic)
+		}
+		if err != nil || magic[0] != 0x1f || magic[1] != 0x8b {
+			return decodedBody{buffered, resp.Body}, nil
+		}
+	}
+
+	decoder, err := gzip.NewReader(buffered)
+	if err != nil {
+		return nil, err
+	}
+	return decodedBody{decoder, resp.Body}, nil
+}
+
+func (b *httpBackend) Exists(key string) (bool, error) {
+	req, err := b.newRequest("HEAD", key, nil)
+	if err != nil {
+		return false, err
+	}
+
+	resp, err := b.do(req)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+
+	return resp.StatusCode != http.StatusNotFound, nil
+}
+
+func (b *httpBackend) Delete(key string) error {
+	req, err := b.newRequest("DELETE", key, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := b.do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	return nil
+}
+
+// httpStreamBackend streams uploads with --http-chunked. The archive is sent
+// with chunked transfer encoding as it is written, which not every server
+// accepts, and the upload can't be retried.
+type httpStreamBackend struct {
+	*httpBackend
+}
+
+func (b httpStreamBackend) PutStream(key string, body io.Reader) error {
+	buffered := bufio.NewReader(body)
+	head, _ := buffered.Peek(512)
+
+	req, err := b.newRequest("PUT", key, buffered)
+	if err != nil {
+		return err
+	}
+
+	/* Unknown, so the body is sent chunked */
+	req.ContentLength = -1
+	req.Header.Set("Content-Type", sniffContentType(head))
+
+	return b.put(req)
+}
+
+// List is not supported, plain HTTP has no standard way to list a directory.
+func (b *httpBackend) List(prefix string) ([]string, error) {
+	return nil, errors.New("listing is not supported by http storage")
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// ipfsRoot is the directory in the node's mutable file system that maps keys
+// to the CIDs of pinned archives.
+const ipfsRoot = "/bundle_cache"
+
+// ipfsBackend adds archives to an IPFS node through the Kubo RPC API and
+// fetches them through a gateway, which can be one close to the runner.
+// Keys are resolved to CIDs through the mutable file system of the API node.
+type ipfsBackend struct {
+	api     string
+	gateway string
+	client  *http.Client
+}
+
+// ipfsError is the error body returned by the RPC API.
+type ipfsError struct {
+	Message string
+}
+
+func (e *ipfsError) Error() string {
+	return e.Message
+}
+
+func newIPFSBackend() Backend {
+	backend := &ipfsBackend{
+		api:     strings.TrimSuffix(options.IPFSAPI, "/"),
+		gateway: strings.TrimSuffix(options.IPFSGateway, "/"),
+		client:  http.DefaultClient,
+	}
+
+	if needsCustomTransport() {
+		backend.client = newHTTPClient()
+	}
+
+	return backend
+}
+
+func (b *ipfsBackend) path(key string) string {
+	return path.Join(ipfsRoot, key)
+}
+
+// call invokes an RPC command and decodes the JSON response into out, if
+// given.
+func (b *ipfsBackend) call(command string, params url.Values, body io.Reader, contentType string, out interface{}) error {
+	req, err := http.NewRequestWithContext(transferContext, "POST", fmt.Sprintf("%s/api/v0/%s?%s", b.api, command, params.Encode()), body)
+	if err != nil {
+		return err
+	}
+	if len(contentType) > 0 {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		rpcErr := &ipfsError{Message: resp.Status}
+		json.NewDecoder(resp.Body).Decode(rpcErr)
+		return rpcErr
+	}
+
+	if out == nil {
+		return nil
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func isIPFSNotFound(err error) bool {
+	var rpcErr *ipfsError
+	return errors.As(err, &rpcErr) && strings.Contains(rpcErr.Message, "does not exist")
+}
+
+// stat returns the CID stored under key.
+func (b *ipfsBackend) stat(key string) (string, error) {
+	var stat struct {
+		Hash string
+	}
+
+	err := b.call("files/stat", url.Values{"arg": {b.path(key)}}, nil, "", &stat)
+	return stat.Hash, err
+}
+
+// Put adds and pins the archive, then links it into the mutable file system
+// under key. The multipart body is streamed so the archive is not buffered.
+func (b *ipfsBackend) Put(key string, body io.ReadSeeker, size int64) error {
+	reader, writer := io.Pipe()
+	form := multipart.NewWriter(writer)
+
+	go func() {
+		part, err := form.CreateFormFile("file", path.Base(key))
+		if err == nil {
+			_, err = io.Copy(part, body)
+		}
+		if err == nil {
+			err = form.Close()
+		}
+		writer.CloseWithError(err)
+	}()
+
+	var added struct {
+		Hash string
+	}
+
+	params := url.Values{"pin": {"true"}, "cid-version": {"1"}}
+	if err := b.call("add", params, reader, form.FormDataContentType(), &added); err != nil {
+		return err
+	}
+	fmt.Println("Pinned as", added.Hash)
+
+	if err := b.call("files/mkdir", url.Values{"arg": {path.Dir(b.path(key))}, "parents": {"true"}}, nil, "", nil); err != nil {
+		return err
+	}
+
+	/* files/cp refuses to overwrite an existing entry */
+	if err := b.call("files/rm", url.Values{"arg": {b.path(key)}}, nil, "", nil); err != nil && !isIPFSNotFound(err) {
+		return err
+	}
+
+	return b.call("files/cp", url.Values{"arg": {"/ipfs/" + added.Hash, b.path(key)}}, nil, "", nil)
+}
+
+func (b *ipfsBackend) Get(key string) (io.ReadCloser, error) {
+	cid, err := b.stat(key)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(transferContext, "GET", fmt.Sprintf("%s/ipfs/%s", b.gateway, cid), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := doRequest(b.client, req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s not found on gateway", cid)
+	}
+
+	return resp.Body, nil
+}
+
+func (b *ipfsBackend) Exists(key string) (bool, error) {
+	_, err := b.stat(key)
+	if isIPFSNotFound(err) {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+// Delete unlinks key and unpins its archive, which is then removed by the
+// node's garbage collection.
+func (b *ipfsBackend) Delete(key string) error {
+	cid, err := b.stat(key)
+	if isIPFSNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := b.call("files/rm", url.Values{"arg": {b.path(key)}}, nil, "", nil); err != nil {
+		return err
+	}
+
+	if err := b.call("pin/rm", url.Values{"arg": {cid}}, nil, "", nil); err != nil && !strings.Contains(err.Error(), "not pinned") {
+		return err
+	}
+
+	return nil
+}
+
+// List returns the entries of the directory prefix points into.
+func (b *ipfsBackend) List(prefix string) ([]string, error) {
+	dir := path.Dir(strings.TrimPrefix(prefix, "/"))
+
+	var listing struct {
+		Entries []struct {
+			Name string
+			Type int
+		}
+	}
+
+	err := b.call("files/ls", url.Values{"arg": {path.Join(ipfsRoot, dir)}, "long": {"true"}}, nil, "", &listing)
+	if isIPFSNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []string
+	for _, entry := range listing.Entries {
+		/* Type 1 is a directory */
+		if entry.Type == 1 {
+			continue
+		}
+
+		key := storedKey(prefix, path.Join(dir, entry.Name))
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys, nil
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// multipartConcurrency is the number of parts transferred at a time.
+const multipartConcurrency = 4
+
+// multipartBackend stores archives larger than --max-object-size as
+// numbered parts, "<key>.part0001" and so on, tied together by a
+// "<key>.parts.json" manifest. Some S3-compatible stores reject objects over
+// 5GB. Smaller archives are stored as they are.
+type multipartBackend struct {
+	Backend
+	maxSize int64
+}
+
+type partsManifest struct {
+	Size     int64    `json:"size"`
+	PartSize int64    `json:"part_size"`
+	Parts    []string `json:"parts"`
+}
+
+func newMultipartBackend(backend Backend) Backend {
+	if _, ok := backend.(treeSyncer); ok || options.MaxObjectSize <= 0 {
+		return backend
+	}
+
+	return &multipartBackend{Backend: backend, maxSize: int64(options.MaxObjectSize)}
+}
+
+func partsManifestKey(key string) string {
+	return key + ".parts.json"
+}
+
+// forEachObjectPart runs fn for every part with bounded concurrency and
+// returns the first error.
+func forEachObjectPart(manifest *partsManifest, fn func(i int, offset int64, size int64) error) error {
+	return forEachRange(manifest.Size, manifest.PartSize, multipartConcurrency, fn)
+}
+
+// forEachRange runs fn for every partSize range of total bytes, concurrency
+// at a time, and returns the first error.
+func forEachRange(total int64, partSize int64, concurrency int, fn func(i int, offset int64, size int64) error) error {
+	count := int((total + partSize - 1) / partSize)
+
+	return forEachIndex(count, concurrency, func(i int) error {
+		offset := int64(i) * partSize
+		size := partSize
+		if offset+size > total {
+			size = total - offset
+		}
+
+		if err := fn(i, offset, size); err != nil {
+			return fmt.Errorf("part %d: %w", i+1, err)
+		}
+		return nil
+	})
+}
+
+// forEachIndex runs fn for every index below count, concurrency at a time,
+// and returns the first error.
+func forEachIndex(count int, concurrency int, fn func(i int) error) error {
+	var wait sync.WaitGroup
+	var once sync.Once
+	var firstErr error
+
+	slots := make(chan struct{}, concurrency)
+
+	for i := 0; i < count; i++ {
+		wait.Add(1)
+		slots <- struct{}{}
+
+		go func(i int) {
+			defer wait.Done()
+			defer func() { <-slots }()
+
+			if err := fn(i); err != nil {
+				once.Do(func() { firstErr = err })
+			}
+		}(i)
+	}
+
+	wait.Wait()
+	return firstErr
+}
+
+func (b *multipartBackend) Put(key string, body io.ReadSeeker, size int64) error {
+	if size <= b.maxSize {
+		return b.Backend.Put(key, body, size)
+	}
+
+	manifest := &partsManifest{Size: size, PartSize: b.maxSize}
+	for offset := int64(0); offset < size; offset += b.maxSize {
+		manifest.Parts = append(manifest.Parts, fmt.Sprintf("%s.part%04d", key, len(manifest.Parts)+1))
+	}
+
+	fmt.Printf("Uploading %d parts...\n", len(manifest.Parts))
+	err := withLocalFile(body, func(path string) error {
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		return forEachObjectPart(manifest, func(i int, offset int64, size int64) error {
+			return b.Backend.Put(manifest.Parts[i], io.NewSectionReader(file, offset, size), size)
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	/* Written last, so an interrupted upload doesn't count as stored */
+	data, _ := json.Marshal(manifest)
+	return b.Backend.Put(partsManifestKey(key), bytes.NewReader(data), int64(len(data)))
+}
+
+// manifest returns the parts manifest of key, or false if key isn't stored
+// in parts.
+func (b *multipartBackend) manifest(key string) (*partsManifest, bool, error) {
+	exists, err := b.Backend.Exists(partsManifestKey(key))
+	if err != nil || !exists {
+		return nil, false, err
+	}
+
+	body, err := b.Backend.Get(partsManifestKey(key))
+	if err != nil {
+		return nil, false, err
+	}
+	defer body.Close()
+
+	var manifest partsManifest
+	if err := json.NewDecoder(body).Decode(&manifest); err != nil {
+		return nil, false, fmt.Errorf("invalid parts manifest: %s", err)
+	}
+
+	return &manifest, true, nil
+}
+
+// Get returns the parts of a split archive one after the other.
+func (b *multipartBackend) Get(key string) (io.ReadCloser, error) {
+	body, err := b.Backend.Get(key)
+	if err == nil {
+		return body, nil
+	}
+
+	manifest, found, manifestErr := b.manifest(key)
+	if manifestErr != nil || !found {
+		return nil, err
+	}
+
+	reader, writer := io.Pipe()
+	go func() {
+		for _, part := range manifest.Parts {
+			body, err := b.Backend.Get(part)
+			if err != nil {
+				writer.CloseWithError(err)
+				return
+			}
+
+			_, err = io.Copy(writer, body)
+			body.Close()
+			if err != nil {
+				writer.CloseWithError(err)
+				return
+			}
+		}
+		writer.Close()
+	}()
+
+	return reader, nil
+}
+
+// DownloadFile fetches the parts of a split archive in parallel, each
+// written at its offset in file.
+func (b *multipartBackend) DownloadFile(key string, file *os.File) (int64, error) {
+	if exists, err := b.Backend.Exists(key); err != nil || exists {
+		if err != nil {
+			return 0, err
+		}
+		return downloadFile(b.Backend, key, file)
+	}
+
+	manifest, found, err := b.manifest(key)
+	if err != nil {
+		return 0, err
+	}
+	if !found {
+		return downloadFile(b.Backend, key, file)
+	}
+
+	err = forEachObjectPart(manifest, func(i int, offset int64, size int64) error {
+		body, err := b.Backend.Get(manifest.Parts[i])
+		if err != nil {
+			return err
+		}
+		defer body.Close()
+
+		written, err := io.Copy(io.NewOffsetWriter(file, offset), body)
+		if err == nil && written != size {
+			err = fmt.Errorf("expected %d bytes, got %d", size, written)
+		}
+		return err
+	})
+
+	return manifest.Size, err
+}
+
+func (b *multipartBackend) Exists(key string) (bool, error) {
+	exists, err := b.Backend.Exists(key)
+	if err != nil || exists {
+		return exists, err
+	}
+
+	return b.Backend.Exists(partsManifestKey(key))
+}
+
+func (b *multipartBackend) Delete(key string) error {
+	manifest, found, err := b.manifest(key)
+	if err != nil {
+		return err
+	}
+
+	if found {
+		for _, part := range manifest.Parts {
+			if err := b.Backend.Delete(part); err != nil {
+				return err
+			}
+		}
+		if err := b.Backend.Delete(partsManifestKey(key)); err != nil {
+			return err
+		}
+	}
+
+	return b.Backend.Delete(key)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/oauth2"
+)
+
+// The personal cloud drive backends authorize with the OAuth device flow on
+// first use and keep the token, refreshed as needed, in the config
+// directory.
+
+func checkOAuthClient() {
+	if len(options.OAuthClientID) == 0 && envDefined("BUNDLE_CACHE_OAUTH_CLIENT_ID") {
+		options.OAuthClientID = os.Getenv("BUNDLE_CACHE_OAUTH_CLIENT_ID")
+	}
+
+	if len(options.OAuthClientSecret) == 0 && envDefined("BUNDLE_CACHE_OAUTH_CLIENT_SECRET") {
+		options.OAuthClientSecret = os.Getenv("BUNDLE_CACHE_OAUTH_CLIENT_SECRET")
+	}
+
+	if len(options.OAuthClientID) == 0 {
+		terminate("Please provide OAuth client ID", ERR_NO_CREDENTIALS)
+	}
+}
+
+func configDir() string {
+	if len(options.ConfigDir) > 0 {
+		return options.ConfigDir
+	}
+
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		terminate(fmt.Sprintf("Unable to find config directory: %s", err), ERR_FILE_ACCESS)
+	}
+
+	return filepath.Join(dir, "bundle_cache")
+}
+
+func loadToken(path string) (*oauth2.Token, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var token oauth2.Token
+	if err := json.Unmarshal(data, &token); err != nil {
+		return nil, err
+	}
+
+	return &token, nil
+}
+
+func saveToken(path string, token *oauth2.Token) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(token)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, data, 0600)
+}
+
+// savingTokenSource writes every token it hands out to disk. Wrapped in
+// oauth2.ReuseTokenSource it is only asked for refreshed tokens.
+type savingTokenSource struct {
+	source oauth2.TokenSource
+	path   string
+}
+
+func (s *savingTokenSource) Token() (*oauth2.Token, error) {
+	token, err := s.source.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := saveToken(s.path, token); err != nil {
+		fmt.Printf("Unable to save OAuth token: %s\n", err)
+	}
+
+	return token, nil
+}
+
+// newOAuthClient returns an HTTP client authorized for name, running the
+// device flow when no token is stored yet.
+func newOAuthClient(name string, endpoint oauth2.Endpoint, scopes ...string) *http.Client {
+	checkOAuthClient()
+
+	config := &oauth2.Config{
+		ClientID:     options.OAuthClientID,
+		ClientSecret: options.OAuthClientSecret,
+		Endpoint:     endpoint,
+		Scopes:       scopes,
+	}
+
+	ctx := context.Background()
+	if needsCustomTransport() {
+		ctx = context.WithValue(ctx, oauth2.HTTPClient, newHTTPClient())
+	}
+
+	path := filepath.Join(configDir(), name+"_token.json")
+
+	token, err := loadToken(path)
+	if err != nil {
+		auth, err := config.DeviceAuth(ctx)
+		if err != nil {
+			terminate(fmt.Sprintf("Unable to start authorization: %s", err), ERR_NO_CREDENTIALS)
+		}
+
+		fmt.Printf("To authorize bundle_cache, visit %s and enter code %s\n", auth.VerificationURI, auth.UserCode)
+
+		token, err = config.DeviceAccessToken(ctx, auth)
+		if err != nil {
+			terminate(fmt.Sprintf("Authorization failed: %s", err), ERR_NO_CREDENTIALS)
+		}
+
+		if err := saveToken(path, token); err != nil {
+			fmt.Printf("Unable to save OAuth token: %s\n", err)
+		}
+	}
+
+	source := &savingTokenSource{source: config.TokenSource(ctx, token), path: path}
+	return oauth2.NewClient(ctx, oauth2.ReuseTokenSource(token, source))
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"golang.org/x/oauth2/endpoints"
+)
+
+const onedriveAppRoot = "https://graph.microsoft.com/v1.0/me/drive/special/approot"
+
+// Upload session chunks must be a multiple of 320 KiB.
+const onedriveChunkSize = 32 * 320 << 10
+
+// onedriveBackend stores archives below the application folder of a
+// OneDrive, using the key as path.
+type onedriveBackend struct {
+	client *http.Client
+	upload *http.Client
+}
+
+type onedriveItem struct {
+	Name   string    `json:"name"`
+	Folder *struct{} `json:"folder"`
+}
+
+type onedriveChildren struct {
+	Value    []onedriveItem `json:"value"`
+	NextLink string         `json:"@odata.nextLink"`
+}
+
+func newOneDriveBackend() Backend {
+	client := newOAuthClient("onedrive", endpoints.AzureAD("common"), "Files.ReadWrite.AppFolder", "offline_access")
+
+	/* Upload session URLs are pre-authorized and reject bearer tokens */
+	upload := http.DefaultClient
+	if needsCustomTransport() {
+		upload = newHTTPClient()
+	}
+
+	return &onedriveBackend{client: client, upload: upload}
+}
+
+func (b *onedriveBackend) itemURL(key string, suffix string) string {
+	item := (&url.URL{Path: strings.TrimPrefix(key, "/")}).EscapedPath()
+	return fmt.Sprintf("%s:/%s:%s", onedriveAppRoot, item, suffix)
+}
+
+// Put uploads in chunks through an upload session, simple uploads are
+// limited to 4MB.
+func (b *onedriveBackend) Put(key string, body io.ReadSeeker, size int64) error {
+	payload, _ := json.Marshal(map[string]interface{}{
+		"item": map[string]string{"@microsoft.graph.conflictBehavior": "replace"},
+	})
+
+	req, err := http.NewRequestWithContext(transferContext, "POST", b.itemURL(key, "/createUploadSession"), bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := doRequest(b.client, req)
+	if err != nil {
+		return err
+	}
+
+	var session struct {
+		UploadURL string `json:"uploadUrl"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&session)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+
+	chunk := make([]byte, onedriveChunkSize)
+	for offset := int64(0); offset < size; {
+		n, err := io.ReadFull(body, chunk)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return err
+		}
+
+		req, err := http.NewRequestWithContext(transferContext, "PUT", session.UploadURL, bytes.NewReader(chunk[:n]))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, offset+int64(n)-1, size))
+
+		resp, err := doRequest(b.upload, req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+
+		offset += int64(n)
+	}
+
+	return nil
+}
+
+func (b *onedriveBackend) Get(key string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(transferContext, "GET", b.itemURL(key, "/content"), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := doRequest(b.client, req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, fmt.Errorf("item %s not found", key)
+	}
+
+	return resp.Body, nil
+}
+
+func (b *onedriveBackend) Exists(key string) (bool, error) {
+	req, err := http.NewRequestWithContext(transferContext, "GET", b.itemURL(key, ""), nil)
+	if err != nil {
+		return false, err
+	}
+
+	resp, err := doRequest(b.client, req)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+
+	return resp.StatusCode != http.StatusNotFound, nil
+}
+
+func (b *onedriveBackend) Delete(key string) error {
+	req, err := http.NewRequestWithContext(transferContext, "DELETE", b.itemURL(key, ""), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := doRequest(b.client, req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	return nil
+}
+
+// List only looks at the folder the prefix points into, which is where
+// archives sharing a prefix are stored.
+func (b *onedriveBackend) List(prefix string) ([]string, error) {
+	dir := path.Dir(strings.TrimPrefix(prefix, "/"))
+
+	next := onedriveAppRoot + "/children"
+	if dir != "." {
+		next = b.itemURL(dir, "/children")
+	}
+
+	var keys []string
+
+	for len(next) > 0 {
+		req, err := http.NewRequestWithContext(transferContext, "GET", next, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := doRequest(b.client, req)
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode == http.StatusNotFound {
+			resp.Body.Close()
+			return nil, nil
+		}
+
+		var children onedriveChildren
+		err = json.NewDecoder(resp.Body).Decode(&children)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, item := range children.Value {
+			if item.Folder != nil {
+				continue
+			}
+
+			key := storedKey(prefix, path.Join(dir, item.Name))
+			if strings.HasPrefix(key, prefix) {
+				keys = append(keys, key)
+			}
+		}
+
+		next = children.NextLink
+	}
+
+	return keys, nil
+}
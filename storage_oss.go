@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// newOSSBackend talks to Alibaba Cloud OSS through its S3 compatible API.
+// OSS expects the region in its own oss-<region> form and only supports
+// virtual hosted style requests.
+func newOSSBackend() Backend {
+	if len(options.AccessKey) == 0 && envDefined("ALIBABA_CLOUD_ACCESS_KEY_ID") {
+		options.AccessKey = os.Getenv("ALIBABA_CLOUD_ACCESS_KEY_ID")
+	}
+
+	if len(options.SecretKey) == 0 && envDefined("ALIBABA_CLOUD_ACCESS_KEY_SECRET") {
+		options.SecretKey = os.Getenv("ALIBABA_CLOUD_ACCESS_KEY_SECRET")
+	}
+
+	if len(options.Region) == 0 {
+		terminate("Please provide OSS bucket region, e.g. cn-hangzhou", ERR_NO_CREDENTIALS)
+	}
+
+	if options.ForcePathStyle {
+		terminate("OSS does not support path-style requests", ERR_WRONG_USAGE)
+	}
+
+	options.Region = "oss-" + strings.TrimPrefix(options.Region, "oss-")
+
+	if len(options.Endpoint) == 0 {
+		/* The internal endpoint is free and stays on the region's network */
+		host := options.Region
+		if options.OSSInternal {
+			host += "-internal"
+		}
+		options.Endpoint = fmt.Sprintf("https://%s.aliyuncs.com", host)
+	}
+
+	return newS3Backend()
+}
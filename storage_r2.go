@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// newR2Backend talks to Cloudflare R2 through its S3 compatible API. The
+// endpoint is scoped to the account, and to the jurisdiction for buckets
+// created with one. R2 signs with the region "auto".
+func newR2Backend() Backend {
+	if len(options.R2AccountID) == 0 && envDefined("CLOUDFLARE_ACCOUNT_ID") {
+		options.R2AccountID = os.Getenv("CLOUDFLARE_ACCOUNT_ID")
+	}
+
+	if len(options.AccessKey) == 0 && envDefined("R2_ACCESS_KEY_ID") {
+		options.AccessKey = os.Getenv("R2_ACCESS_KEY_ID")
+	}
+
+	if len(options.SecretKey) == 0 && envDefined("R2_SECRET_ACCESS_KEY") {
+		options.SecretKey = os.Getenv("R2_SECRET_ACCESS_KEY")
+	}
+
+	if len(options.R2AccountID) == 0 {
+		terminate("Please provide Cloudflare account ID", ERR_NO_CREDENTIALS)
+	}
+
+	host := options.R2AccountID
+	switch options.R2Jurisdiction {
+	case "":
+	case "eu", "fedramp":
+		host += "." + options.R2Jurisdiction
+	default:
+		terminate(fmt.Sprintf("Unknown R2 jurisdiction: %s", options.R2Jurisdiction), ERR_WRONG_USAGE)
+	}
+
+	if len(options.Region) > 0 && options.Region != "auto" {
+		fmt.Fprintf(notices, "Ignoring region %s, R2 always uses auto\n", options.Region)
+	}
+	options.Region = "auto"
+
+	if len(options.Endpoint) == 0 {
+		options.Endpoint = fmt.Sprintf("https://%s.r2.cloudflarestorage.com", host)
+	}
+
+	backend := newS3Backend().(*s3Backend)
+
+	/* R2 rejects object tags, expiry has to be an age based lifecycle rule */
+	backend.noTagging = true
+
+	return backend
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// Redis refuses strings larger than this.
+const redisMaxValueSize = 512 << 20
+
+// redisBackend keeps small archives in Redis, expiring them after
+// --expire-after when given.
+type redisBackend struct {
+	pool *redis.Pool
+}
+
+func newRedisBackend() Backend {
+	if len(options.RedisURL) == 0 && envDefined("REDIS_URL") {
+		options.RedisURL = os.Getenv("REDIS_URL")
+	}
+
+	if len(options.RedisURL) == 0 {
+		terminate("Please provide Redis URL", ERR_WRONG_USAGE)
+	}
+
+	dialOptions := []redis.DialOption{redis.DialConnectTimeout(options.ConnectTimeout)}
+	if needsCustomTransport() {
+		dialOptions = append(dialOptions,
+			redis.DialTLSConfig(newTLSConfig()),
+			redis.DialTLSSkipVerify(options.InsecureSkipVerify))
+	}
+
+	pool := &redis.Pool{
+		MaxIdle: splitConcurrency,
+		Dial: func() (redis.Conn, error) {
+			return redis.DialURL(options.RedisURL, dialOptions...)
+		},
+	}
+
+	return &redisBackend{pool: pool}
+}
+
+func (b *redisBackend) Put(key string, body io.ReadSeeker, size int64) error {
+	if size > redisMaxValueSize {
+		return fmt.Errorf("archive of %d bytes is too large for Redis", size)
+	}
+
+	value, err := ioutil.ReadAll(body)
+	if err != nil {
+		return err
+	}
+
+	conn := b.pool.Get()
+	defer conn.Close()
+
+	args := redis.Args{key, value}
+	if options.ExpireAfter > 0 {
+		args = args.Add("PX", int64(options.ExpireAfter/time.Millisecond))
+	}
+
+	_, err = conn.Do("SET", args...)
+	return err
+}
+
+func (b *redisBackend) Get(key string) (io.ReadCloser, error) {
+	conn := b.pool.Get()
+	defer conn.Close()
+
+	value, err := redis.Bytes(conn.Do("GET", key))
+	if err == redis.ErrNil {
+		return nil, fmt.Errorf("key %s not found", key)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return ioutil.NopCloser(bytes.NewReader(value)), nil
+}
+
+func (b *redisBackend) Exists(key string) (bool, error) {
+	conn := b.pool.Get()
+	defer conn.Close()
+
+	return redis.Bool(conn.Do("EXISTS", key))
+}
+
+func (b *redisBackend) Delete(key string) error {
+	conn := b.pool.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("DEL", key)
+	return err
+}
+
+var redisPatternChars = strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`, "]", `\]`)
+
+// List walks the keyspace with SCAN, which unlike KEYS does not block the
+// server.
+func (b *redisBackend) List(prefix string) ([]string, error) {
+	conn := b.pool.Get()
+	defer conn.Close()
+
+	var keys []string
+	cursor := 0
+	pattern := redisPatternChars.Replace(prefix) + "*"
+
+	for {
+		values, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", pattern, "COUNT", 1000))
+		if err != nil {
+			return nil, err
+		}
+
+		var batch []string
+		if _, err := redis.Scan(values, &cursor, &batch); err != nil {
+			return nil, err
+		}
+		keys = append(keys, batch...)
+
+		if cursor == 0 {
+			return keys, nil
+		}
+	}
+}
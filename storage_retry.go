@@ -0,0 +1,231 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+// retryMaxDelay caps the backoff between attempts.
+const retryMaxDelay = 30 * time.Second
+
+// retryBackend retries operations failing with throttling, server errors or
+// dropped connections up to --retries times, waiting --retry-delay doubled
+// on every attempt with full jitter. Other errors, like a missing key or
+// denied access, are returned right away.
+type retryBackend struct {
+	Backend
+}
+
+// retryStreamBackend keeps streaming uploads of backends supporting them.
+// The body is consumed as it is sent, so only the backend's own retries of
+// parts apply.
+type retryStreamBackend struct {
+	*retryBackend
+}
+
+func (b retryStreamBackend) PutStream(key string, body io.Reader) error {
+	return b.Backend.(streamUploader).PutStream(key, body)
+}
+
+func newRetryBackend(backend Backend) Backend {
+	/* rsync retries on its own and the tree syncing must stay visible */
+	if _, ok := backend.(treeSyncer); ok || options.Retries <= 0 {
+		return backend
+	}
+
+	retrying := &retryBackend{Backend: backend}
+	if _, ok := backend.(streamUploader); ok {
+		return retryStreamBackend{retrying}
+	}
+
+	return retrying
+}
+
+// retryable reports whether err is worth another attempt.
+func retryable(err error) bool {
+	var status *statusError
+	if errors.As(err, &status) {
+		return retryableStatus(status.code)
+	}
+
+	if reqErr, ok := err.(awserr.RequestFailure); ok {
+		if retryableStatus(reqErr.StatusCode()) {
+			return true
+		}
+		err = reqErr.OrigErr()
+	}
+
+	if awsErr, ok := err.(awserr.Error); ok {
+		switch awsErr.Code() {
+		case "SlowDown", "Throttling", "ThrottlingException", "RequestTimeout", "RequestError":
+			return true
+		}
+		err = awsErr.OrigErr()
+	}
+
+	if err == nil {
+		return false
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.EPIPE)
+}
+
+func retryableStatus(code int) bool {
+	return code == http.StatusTooManyRequests || code == http.StatusRequestTimeout || code >= 500
+}
+
+// retryDelay returns a random wait of up to --retry-delay doubled attempt
+// times.
+func retryDelay(attempt int) time.Duration {
+	delay := options.RetryDelay << uint(attempt)
+	if delay > retryMaxDelay || delay <= 0 {
+		delay = retryMaxDelay
+	}
+
+	return time.Duration(rand.Int63n(int64(delay) + 1))
+}
+
+// retry runs fn until it succeeds, fails for good, runs out of attempts or
+// --transfer-timeout runs out. before runs ahead of every retry, e.g. to
+// rewind a body.
+func retry(what string, before func() error, fn func() error) error {
+	err := fn()
+
+	for attempt := 0; attempt < options.Retries && err != nil && retryable(err); attempt++ {
+		if transferContext.Err() != nil {
+			break
+		}
+
+		delay := retryDelay(attempt)
+		fmt.Fprintf(notices, "%s failed: %s, retrying in %s\n", what, err, delay.Round(time.Millisecond))
+		select {
+		case <-time.After(delay):
+		case <-transferContext.Done():
+			return fmt.Errorf("timed out after %s: %s", options.TransferTimeout, err)
+		}
+
+		if before != nil {
+			if rewindErr := before(); rewindErr != nil {
+				return rewindErr
+			}
+		}
+		err = fn()
+	}
+
+	if err != nil && transferContext.Err() != nil {
+		return fmt.Errorf("timed out after %s: %s", options.TransferTimeout, err)
+	}
+	return err
+}
+
+func (b *retryBackend) Put(key string, body io.ReadSeeker, size int64) error {
+	current := body
+
+	rewind := func() error {
+		/* HTTP clients close file bodies once sent, so files are opened again */
+		if file, ok := body.(*os.File); ok {
+			reopened, err := os.Open(file.Name())
+			if err != nil {
+				return err
+			}
+			if current != body {
+				current.(*os.File).Close()
+			}
+			current = reopened
+			return nil
+		}
+
+		_, err := body.Seek(0, io.SeekStart)
+		return err
+	}
+	defer func() {
+		if current != body {
+			current.(*os.File).Close()
+		}
+	}()
+
+	return retry("Upload of "+key, rewind, func() error {
+		return b.Backend.Put(key, current, size)
+	})
+}
+
+func (b *retryBackend) Get(key string) (io.ReadCloser, error) {
+	var body io.ReadCloser
+
+	err := retry("Download of "+key, nil, func() error {
+		var err error
+		body, err = b.Backend.Get(key)
+		return err
+	})
+
+	return body, err
+}
+
+// DownloadFile starts over with an empty file on every attempt, unless
+// --resume continues where the last one stopped.
+func (b *retryBackend) DownloadFile(key string, file *os.File) (int64, error) {
+	var written int64
+
+	rewind := func() error {
+		if options.Resume {
+			return nil
+		}
+		if err := file.Truncate(0); err != nil {
+			return err
+		}
+		_, err := file.Seek(0, io.SeekStart)
+		return err
+	}
+
+	err := retry("Download of "+key, rewind, func() error {
+		var err error
+		written, err = downloadFile(b.Backend, key, file)
+		return err
+	})
+
+	return written, err
+}
+
+func (b *retryBackend) Exists(key string) (bool, error) {
+	var exists bool
+
+	err := retry("Lookup of "+key, nil, func() error {
+		var err error
+		exists, err = b.Backend.Exists(key)
+		return err
+	})
+
+	return exists, err
+}
+
+func (b *retryBackend) Delete(key string) error {
+	return retry("Removal of "+key, nil, func() error {
+		return b.Backend.Delete(key)
+	})
+}
+
+func (b *retryBackend) List(prefix string) ([]string, error) {
+	var keys []string
+
+	err := retry("Listing of "+prefix, nil, func() error {
+		var err error
+		keys, err = b.Backend.List(prefix)
+		return err
+	})
+
+	return keys, err
+}
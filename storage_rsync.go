@@ -0,0 +1,207 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os/exec"
+	"path"
+	"strings"
+)
+
+// treeSyncer is implemented by backends that store the unarchived bundle
+// and transfer only what changed, instead of whole archives.
+type treeSyncer interface {
+	UploadTree(key string, dir string) error
+	DownloadTree(key string, dir string) error
+}
+
+// rsyncBackend keeps bundles as plain directory trees on a remote host and
+// syncs them with rsync over SSH. New trees hard link unchanged files from
+// the previous upload of the same prefix, so only changed gems are sent and
+// stored. Single files such as split parts are synced as they are.
+type rsyncBackend struct {
+	target string
+	ssh    string
+	root   string
+}
+
+func newRsyncBackend() Backend {
+	if len(options.Host) == 0 {
+		terminate("Please provide rsync host", ERR_WRONG_USAGE)
+	}
+
+	host := options.Host
+	ssh := []string{"ssh", "-o", "BatchMode=yes", "-o", "LogLevel=ERROR"}
+
+	if h, port, err := net.SplitHostPort(host); err == nil {
+		host = h
+		ssh = append(ssh, "-p", port)
+	}
+
+	if len(options.SSHKey) > 0 {
+		ssh = append(ssh, "-i", shellQuote(options.SSHKey))
+	}
+
+	if len(options.KnownHosts) > 0 {
+		ssh = append(ssh, "-o", shellQuote("UserKnownHostsFile="+options.KnownHosts), "-o", "StrictHostKeyChecking=yes")
+	}
+
+	if options.ConnectTimeout > 0 {
+		seconds := int(math.Ceil(options.ConnectTimeout.Seconds()))
+		ssh = append(ssh, "-o", fmt.Sprintf("ConnectTimeout=%d", seconds))
+	}
+
+	if len(options.User) > 0 {
+		host = options.User + "@" + host
+	}
+
+	root := options.CacheDir
+	if len(root) == 0 {
+		root = "."
+	}
+
+	return &rsyncBackend{target: host, ssh: strings.Join(ssh, " "), root: root}
+}
+
+func (b *rsyncBackend) path(key string) string {
+	return path.Join(b.root, strings.TrimPrefix(key, "/"))
+}
+
+// treePath is where the tree for an archive key is stored.
+func (b *rsyncBackend) treePath(key string) string {
+	return strings.TrimSuffix(b.path(key), options.ArchiveExt)
+}
+
+func (b *rsyncBackend) remote(p string) string {
+	return shellQuote(fmt.Sprintf("%s:%s", b.target, p))
+}
+
+// run executes command on the remote host.
+func (b *rsyncBackend) run(command string) (string, error) {
+	output, err := sh(fmt.Sprintf("%s %s %s", b.ssh, shellQuote(b.target), shellQuote(command)))
+	if err != nil {
+		return output, fmt.Errorf("%w: %s", err, strings.TrimSpace(output))
+	}
+	return output, nil
+}
+
+// bwlimitArgs passes --max-bandwidth to rsync, which takes KB/s.
+func bwlimitArgs() []string {
+	if options.MaxBandwidth <= 0 {
+		return nil
+	}
+
+	limit := int64(options.MaxBandwidth) >> 10
+	if limit < 1 {
+		limit = 1
+	}
+	return []string{fmt.Sprintf("--bwlimit=%d", limit)}
+}
+
+// rsync runs rsync with args, creating the parent directory of remotePath
+// on the remote host first.
+func (b *rsyncBackend) rsync(remotePath string, args ...string) error {
+	mkdir := fmt.Sprintf("mkdir -p %s && rsync", shellQuote(path.Dir(remotePath)))
+	command := fmt.Sprintf("rsync -e %s --rsync-path=%s %s", shellQuote(b.ssh), shellQuote(mkdir), strings.Join(args, " "))
+
+	if output, err := sh(command); err != nil {
+		return fmt.Errorf("%s: %s", err, strings.TrimSpace(output))
+	}
+	return nil
+}
+
+func (b *rsyncBackend) Put(key string, body io.ReadSeeker, size int64) error {
+	return withLocalFile(body, func(local string) error {
+		return b.rsync(b.path(key), "-t", shellQuote(local), b.remote(b.path(key)))
+	})
+}
+
+func (b *rsyncBackend) Get(key string) (io.ReadCloser, error) {
+	return fetchTempFile(func(local string) error {
+		return b.rsync(b.path(key), b.remote(b.path(key)), shellQuote(local))
+	})
+}
+
+func (b *rsyncBackend) Exists(key string) (bool, error) {
+	_, err := b.run(fmt.Sprintf("test -e %s || test -d %s", shellQuote(b.path(key)), shellQuote(b.treePath(key))))
+	if err == nil {
+		return true, nil
+	}
+
+	/* ssh itself fails with 255, a failed test exits with 1 */
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+		return false, nil
+	}
+
+	return false, err
+}
+
+func (b *rsyncBackend) Delete(key string) error {
+	_, err := b.run(fmt.Sprintf("rm -rf %s %s", shellQuote(b.path(key)), shellQuote(b.treePath(key))))
+	return err
+}
+
+// List returns the files and trees in the directory prefix points into,
+// reporting trees by their archive key.
+func (b *rsyncBackend) List(prefix string) ([]string, error) {
+	dir := path.Dir(strings.TrimPrefix(prefix, "/"))
+
+	output, err := b.run(fmt.Sprintf("ls -1p %s 2>/dev/null || true", shellQuote(path.Join(b.root, dir))))
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []string
+	for _, name := range strings.Split(strings.TrimSpace(output), "\n") {
+		if len(name) == 0 || strings.HasSuffix(name, ".partial/") {
+			continue
+		}
+		if strings.HasSuffix(name, "/") {
+			name = strings.TrimSuffix(name, "/") + options.ArchiveExt
+		}
+
+		key := storedKey(prefix, path.Join(dir, name))
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys, nil
+}
+
+// UploadTree syncs dir into a staging tree next to the final one, hard
+// linking unchanged files from the latest tree of the prefix, then moves it
+// into place and marks it as the latest.
+func (b *rsyncBackend) UploadTree(key string, dir string) error {
+	tree := b.treePath(key)
+	staging := tree + ".partial"
+	latest := fmt.Sprintf(".%s.latest", options.Prefix)
+
+	args := append([]string{"-a", "--delete", "--link-dest=" + shellQuote("../"+latest+"/")}, bwlimitArgs()...)
+	for _, exclude := range options.Exclude {
+		args = append(args, "--exclude="+shellQuote(exclude))
+	}
+	args = append(args, shellQuote(strings.TrimSuffix(dir, "/")+"/"), b.remote(staging+"/"))
+
+	err := b.rsync(staging, args...)
+	if err != nil {
+		return err
+	}
+
+	_, err = b.run(fmt.Sprintf("rm -rf %s && mv %s %s && ln -sfn %s %s",
+		shellQuote(tree), shellQuote(staging), shellQuote(tree),
+		shellQuote(path.Base(tree)), shellQuote(path.Join(path.Dir(tree), latest))))
+	return err
+}
+
+// DownloadTree syncs the stored tree into dir, transferring only files that
+// differ from what dir already holds.
+func (b *rsyncBackend) DownloadTree(key string, dir string) error {
+	tree := b.treePath(key)
+	args := append([]string{"-a", "--delete"}, bwlimitArgs()...)
+	return b.rsync(tree, append(args, b.remote(tree+"/"), shellQuote(strings.TrimSuffix(dir, "/")+"/"))...)
+}
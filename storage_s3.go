@@ -0,0 +1,691 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/processcreds"
+	"github.com/aws/aws-sdk-go/aws/credentials/ssocreds"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+type s3Backend struct {
+	sess      *session.Session
+	svc       *s3.S3
+	bucket    string
+	noTagging bool
+	// requestPayer is set for requester pays buckets.
+	requestPayer *string
+}
+
+func newS3Backend() Backend {
+	checkS3Credentials()
+
+	sess := newSession()
+	backend := &s3Backend{sess: sess, svc: s3.New(sess), bucket: options.Bucket}
+	if len(options.RequestPayer) > 0 {
+		backend.requestPayer = aws.String(options.RequestPayer)
+	}
+
+	return backend
+}
+
+// Put uploads with s3manager, which sends archives over --part-size as a
+// multipart upload with --upload-concurrency parts at a time, retrying
+// failed parts on their own.
+func (b *s3Backend) Put(key string, body io.ReadSeeker, size int64) error {
+	if file, ok := body.(*os.File); ok && options.Resume && size > uploadPartSize(size) {
+		return b.resumeUpload(key, file, size)
+	}
+
+	return b.upload(key, body, detectContentType(body))
+}
+
+// PutStream uploads body part by part as it is read, without knowing the
+// size up front.
+func (b *s3Backend) PutStream(key string, body io.Reader) error {
+	buffered := bufio.NewReader(body)
+	head, _ := buffered.Peek(512)
+
+	return b.upload(key, buffered, sniffContentType(head))
+}
+
+func (b *s3Backend) upload(key string, body io.Reader, contentType string) error {
+	params := &s3.PutObjectInput{}
+	if options.ExpireAfter > 0 {
+		setExpiry(params, options.ExpireAfter)
+		if b.noTagging {
+			params.Tagging = nil
+		}
+	}
+
+	uploader := s3manager.NewUploader(b.sess, func(u *s3manager.Uploader) {
+		u.Concurrency = options.UploadConcurrency
+		if options.PartSize > 0 {
+			u.PartSize = int64(options.PartSize)
+		}
+	})
+
+	_, err := uploader.UploadWithContext(transferContext, &s3manager.UploadInput{
+		Bucket:       aws.String(b.bucket),
+		Key:          aws.String(key),
+		RequestPayer: b.requestPayer,
+		Body:         body,
+		ContentType:  aws.String(contentType),
+		Expires:      params.Expires,
+		Metadata:     params.Metadata,
+		Tagging:      params.Tagging,
+	})
+	return err
+}
+
+// Presign signs a GET or PUT request for key valid for expiry, at most 7
+// days with SigV4.
+func (b *s3Backend) Presign(method string, key string, expiry time.Duration) (string, error) {
+	if method == "PUT" {
+		req, _ := b.svc.PutObjectRequest(&s3.PutObjectInput{
+			Bucket:       aws.String(b.bucket),
+			Key:          aws.String(key),
+			RequestPayer: b.requestPayer,
+		})
+		return req.Presign(expiry)
+	}
+
+	req, _ := b.svc.GetObjectRequest(&s3.GetObjectInput{
+		Bucket:       aws.String(b.bucket),
+		Key:          aws.String(key),
+		RequestPayer: b.requestPayer,
+	})
+	return req.Presign(expiry)
+}
+
+func (b *s3Backend) Get(key string) (io.ReadCloser, error) {
+	out, err := b.svc.GetObjectWithContext(transferContext, &s3.GetObjectInput{
+		Bucket:       aws.String(b.bucket),
+		Key:          aws.String(key),
+		RequestPayer: b.requestPayer,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return out.Body, nil
+}
+
+func (b *s3Backend) Exists(key string) (bool, error) {
+	_, err := b.svc.HeadObjectWithContext(transferContext, &s3.HeadObjectInput{
+		Bucket:       aws.String(b.bucket),
+		Key:          aws.String(key),
+		RequestPayer: b.requestPayer,
+	})
+	if err == nil {
+		return true, nil
+	}
+
+	if reqErr, ok := err.(awserr.RequestFailure); ok && reqErr.StatusCode() == http.StatusNotFound {
+		return false, nil
+	}
+
+	/* Without listing allowed, S3 hides missing keys behind 403 */
+	if reqErr, ok := err.(awserr.RequestFailure); ok && reqErr.StatusCode() == http.StatusForbidden && options.NoSignRequest {
+		return false, nil
+	}
+
+	return false, err
+}
+
+func (b *s3Backend) Delete(key string) error {
+	_, err := b.svc.DeleteObjectWithContext(transferContext, &s3.DeleteObjectInput{
+		Bucket:       aws.String(b.bucket),
+		Key:          aws.String(key),
+		RequestPayer: b.requestPayer,
+	})
+	return err
+}
+
+func (b *s3Backend) List(prefix string) ([]string, error) {
+	var keys []string
+
+	err := b.svc.ListObjectsV2PagesWithContext(transferContext, &s3.ListObjectsV2Input{
+		Bucket:       aws.String(b.bucket),
+		Prefix:       aws.String(prefix),
+		RequestPayer: b.requestPayer,
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, object := range page.Contents {
+			keys = append(keys, aws.StringValue(object.Key))
+		}
+		return true
+	})
+
+	return keys, err
+}
+
+// DownloadFile uses s3manager to fetch the object with parallel ranged
+// requests, sized by downloadTuning unless set with --part-size and
+// --download-concurrency.
+func (b *s3Backend) DownloadFile(key string, file *os.File) (int64, error) {
+	if options.Resume {
+		return b.resumeDownload(key, file)
+	}
+
+	head, err := b.svc.HeadObjectWithContext(transferContext, &s3.HeadObjectInput{
+		Bucket:       aws.String(b.bucket),
+		Key:          aws.String(key),
+		RequestPayer: b.requestPayer,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	setProgressTotal(aws.Int64Value(head.ContentLength))
+
+	partSize, concurrency := downloadTuning(aws.Int64Value(head.ContentLength))
+	if options.PartSize > 0 {
+		partSize = int64(options.PartSize)
+	}
+	if options.DownloadConcurrency > 0 {
+		concurrency = options.DownloadConcurrency
+	}
+
+	downloader := s3manager.NewDownloader(b.sess, func(d *s3manager.Downloader) {
+		d.PartSize = partSize
+		d.Concurrency = concurrency
+	})
+
+	return downloader.DownloadWithContext(transferContext, file, &s3.GetObjectInput{
+		Bucket:       aws.String(b.bucket),
+		Key:          aws.String(key),
+		RequestPayer: b.requestPayer,
+	})
+}
+
+// downloadTuning picks the part size and concurrency of ranged downloads
+// for an object of size bytes. The SDK defaults of 5 parts of 5MB leave most
+// of a fast link idle on archives of a few GB, while small archives gain
+// nothing from more requests. Parts grow to keep about four per request
+// slot, up to 64MB.
+func downloadTuning(size int64) (int64, int) {
+	concurrency := s3manager.DefaultDownloadConcurrency
+	switch {
+	case size >= 1<<30:
+		concurrency = 16
+	case size >= 128<<20:
+		concurrency = 10
+	}
+
+	partSize := size / int64(concurrency*4)
+	if partSize < s3manager.DefaultDownloadPartSize {
+		partSize = s3manager.DefaultDownloadPartSize
+	}
+	if partSize > 64<<20 {
+		partSize = 64 << 20
+	}
+
+	return partSize, concurrency
+}
+
+func checkS3Credentials() {
+	/* The standard names of the AWS tools, then the ones used originally */
+	if len(options.AccessKey) == 0 && envDefined("AWS_ACCESS_KEY_ID") {
+		options.AccessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+	}
+
+	if len(options.AccessKey) == 0 && envDefined("AWS_ACCESS_KEY") {
+		options.AccessKey = os.Getenv("AWS_ACCESS_KEY")
+	}
+
+	if len(options.SecretKey) == 0 && envDefined("AWS_SECRET_ACCESS_KEY") {
+		options.SecretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	}
+
+	if len(options.SecretKey) == 0 && envDefined("AWS_SECRET_KEY") {
+		options.SecretKey = os.Getenv("AWS_SECRET_KEY")
+	}
+
+	if len(options.SessionToken) == 0 && envDefined("AWS_SESSION_TOKEN") {
+		options.SessionToken = os.Getenv("AWS_SESSION_TOKEN")
+	}
+
+	if len(options.Bucket) == 0 && envDefined("S3_BUCKET") {
+		options.Bucket = os.Getenv("S3_BUCKET")
+	}
+
+	if len(options.Region) == 0 && envDefined("AWS_REGION") {
+		options.Region = os.Getenv("AWS_REGION")
+	}
+
+	if len(options.Region) == 0 && envDefined("AWS_DEFAULT_REGION") {
+		options.Region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+
+	/* Keys given explicitly win over a profile from the environment */
+	if len(options.Profile) == 0 && envDefined("AWS_PROFILE") && len(options.AccessKey) == 0 && len(options.SecretKey) == 0 {
+		options.Profile = os.Getenv("AWS_PROFILE")
+	}
+
+	if len(options.Endpoint) == 0 && envDefined("S3_ENDPOINT") {
+		options.Endpoint = os.Getenv("S3_ENDPOINT")
+	}
+
+	/* Most S3-compatible stores ignore the region but requests still need one */
+	if len(options.Region) == 0 && len(options.Endpoint) > 0 {
+		options.Region = endpointRegion(options.Endpoint)
+	}
+
+	if len(options.Bucket) == 0 {
+		terminate("Please provide S3 bucket name", ERR_NO_CREDENTIALS)
+	}
+
+	if (options.Accelerate || options.DualStack) && len(options.Endpoint) > 0 {
+		terminate("Transfer acceleration and dual-stack are only available on AWS endpoints", ERR_WRONG_USAGE)
+	}
+
+	if options.Accelerate && options.ForcePathStyle {
+		terminate("Transfer acceleration requires virtual hosted style requests", ERR_WRONG_USAGE)
+	}
+
+	if partition := regionPartition(options.Region); options.Accelerate && partition != "aws" {
+		terminate(fmt.Sprintf("Transfer acceleration isn't available in the %s partition", partition), ERR_WRONG_USAGE)
+	}
+
+	if options.UploadConcurrency < 1 {
+		terminate("--upload-concurrency must be at least 1", ERR_WRONG_USAGE)
+	}
+
+	if options.DownloadConcurrency < 0 {
+		terminate("--download-concurrency must be at least 1", ERR_WRONG_USAGE)
+	}
+
+	if options.PartSize > 0 && int64(options.PartSize) < s3manager.MinUploadPartSize {
+		terminate("--part-size must be at least 5MB", ERR_WRONG_USAGE)
+	}
+
+	if len(options.RequestPayer) > 0 && options.RequestPayer != s3.RequestPayerRequester {
+		terminate(fmt.Sprintf("Unknown request payer %q, use requester", options.RequestPayer), ERR_WRONG_USAGE)
+	}
+
+	if len(options.ExternalID) > 0 && len(options.RoleARN) == 0 {
+		terminate("--external-id requires --role-arn", ERR_WRONG_USAGE)
+	}
+
+	if len(options.MFASerial) > 0 && len(options.RoleARN) == 0 {
+		terminate("--mfa-serial requires --role-arn", ERR_WRONG_USAGE)
+	}
+
+	if len(options.MFAToken) > 0 && len(options.MFASerial) == 0 {
+		terminate("--mfa-token requires --mfa-serial", ERR_WRONG_USAGE)
+	}
+
+	/* Public buckets are read without any credentials */
+	if options.NoSignRequest {
+		if len(options.Region) == 0 && !options.RegionFromBucket {
+			terminate("Please provide S3 region name", ERR_NO_CREDENTIALS)
+		}
+		return
+	}
+
+	/* The token replaces keys, the role is assumed without any */
+	if len(options.WebIdentityTokenFile) > 0 {
+		if len(options.RoleARN) == 0 {
+			terminate("--web-identity-token-file requires --role-arn", ERR_WRONG_USAGE)
+		}
+		if len(options.ExternalID) > 0 {
+			terminate("--external-id doesn't apply to --web-identity-token-file", ERR_WRONG_USAGE)
+		}
+		if len(options.Region) == 0 && !options.RegionFromBucket {
+			terminate("Please provide S3 region name", ERR_NO_CREDENTIALS)
+		}
+		return
+	}
+
+	/* The command's credentials win over keys from the environment */
+	if len(options.CredentialsCmd) > 0 {
+		if len(options.Region) == 0 && !options.RegionFromBucket {
+			terminate("Please provide S3 region name", ERR_NO_CREDENTIALS)
+		}
+		return
+	}
+
+	/* Keys and region come from the profile in shared config mode, or from
+	   the SDK's default chain without keys */
+	if useSharedConfig() || useDefaultChain() {
+		return
+	}
+
+	if len(options.AccessKey) == 0 {
+		terminate("Please provide S3 access key", ERR_NO_CREDENTIALS)
+	}
+
+	if len(options.SecretKey) == 0 {
+		terminate("Please provide S3 secret key", ERR_NO_CREDENTIALS)
+	}
+
+	if len(options.Region) == 0 && !options.RegionFromBucket {
+		terminate("Please provide S3 region name", ERR_NO_CREDENTIALS)
+	}
+}
+
+// awsEndpointPattern matches S3 endpoints of AWS in every partition, e.g.
+// s3.us-gov-west-1.amazonaws.com or s3.cn-north-1.amazonaws.com.cn.
+var awsEndpointPattern = regexp.MustCompile(`(^|\.)s3(-fips)?[.-](fips\.)?(dualstack\.)?([a-z]{2}(-gov|-iso[a-z]*)?-[a-z]+-\d+)\.amazonaws\.com(\.cn)?$`)
+
+// endpointRegion returns the region of an AWS endpoint, which requests
+// must be signed for, e.g. GovCloud FIPS endpoints. Other endpoints get
+// us-east-1.
+func endpointRegion(endpoint string) string {
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "https://" + endpoint
+	}
+
+	if parsed, err := url.Parse(endpoint); err == nil {
+		if match := awsEndpointPattern.FindStringSubmatch(parsed.Hostname()); match != nil {
+			return match[5]
+		}
+	}
+
+	return "us-east-1"
+}
+
+// regionPartition returns the AWS partition of region, e.g. aws-us-gov or
+// aws-cn, which have their own endpoints, credentials and features.
+func regionPartition(region string) string {
+	if partition, ok := endpoints.PartitionForRegion(endpoints.DefaultPartitions(), region); ok {
+		return partition.ID()
+	}
+	return "aws"
+}
+
+func useSharedConfig() bool {
+	return options.SharedConfig || len(options.Profile) > 0
+}
+
+// useDefaultChain reports whether S3 credentials are left to the SDK's
+// default chain, which tries the environment, shared config, web identity
+// tokens, ECS task roles and EC2 instance profiles in turn. Other S3
+// compatible stores have no roles and always need keys.
+func useDefaultChain() bool {
+	if options.Storage != "s3" || len(options.BackendCmd) > 0 {
+		return false
+	}
+
+	return len(options.AccessKey) == 0 && len(options.SecretKey) == 0 && !options.NoSignRequest &&
+		len(options.WebIdentityTokenFile) == 0 && len(options.CredentialsCmd) == 0
+}
+
+// writesToStorage reports whether action may store archives, including
+// downloads building the bundle on a miss.
+func writesToStorage(action string) bool {
+	switch action {
+	case "upload", "docker-upload", "presign-upload":
+		return true
+	case "download", "docker-download":
+		return len(options.OnMissExec) > 0
+	}
+	return false
+}
+
+// selectRole assumes --read-role-arn or --write-role-arn depending on
+// action, so builds that only read, e.g. of pull requests from forks, can't
+// overwrite archives.
+func selectRole(action string) {
+	if len(options.ReadRoleARN) == 0 && len(options.WriteRoleARN) == 0 {
+		return
+	}
+
+	if len(options.RoleARN) > 0 {
+		terminate("--role-arn can't be combined with --read-role-arn and --write-role-arn", ERR_WRONG_USAGE)
+	}
+
+	if writesToStorage(action) {
+		options.RoleARN = options.WriteRoleARN
+	} else {
+		options.RoleARN = options.ReadRoleARN
+	}
+}
+
+// checkNoSignRequest refuses --no-sign-request for actions writing to
+// storage, which anonymous requests can't.
+func checkNoSignRequest(action string) {
+	if !options.NoSignRequest {
+		return
+	}
+
+	switch action {
+	case "download", "inspect", "exists", "docker-download":
+	default:
+		terminate(fmt.Sprintf("%s needs credentials, --no-sign-request only works with download, inspect and exists", action), ERR_WRONG_USAGE)
+	}
+
+	if len(options.OnMissExec) > 0 {
+		terminate("--on-miss-exec needs credentials to upload, it doesn't work with --no-sign-request", ERR_WRONG_USAGE)
+	}
+
+	if len(options.RoleARN) > 0 {
+		terminate("--role-arn doesn't work with --no-sign-request", ERR_WRONG_USAGE)
+	}
+}
+
+// newSession builds the AWS session either from static keys or, in shared
+// config mode and without keys, from the full SDK resolution chain including
+// SSO profiles, credential_process and instance roles.
+func newSession() *session.Session {
+	cfg := aws.NewConfig()
+	if len(options.Region) > 0 {
+		cfg = cfg.WithRegion(options.Region)
+	}
+
+	if len(options.Endpoint) > 0 {
+		cfg = cfg.WithEndpoint(options.Endpoint)
+	}
+
+	if options.ForcePathStyle {
+		cfg = cfg.WithS3ForcePathStyle(true)
+	}
+
+	if options.Accelerate {
+		cfg = cfg.WithS3UseAccelerate(true)
+	}
+
+	if options.DualStack {
+		cfg = cfg.WithUseDualStack(true)
+	}
+
+	if needsCustomTransport() {
+		cfg = cfg.WithHTTPClient(newHTTPClient())
+	}
+
+	var sess *session.Session
+
+	if options.NoSignRequest {
+		sess = session.New(cfg.WithCredentials(credentials.AnonymousCredentials))
+	} else if len(options.WebIdentityTokenFile) > 0 {
+		sess = session.New(cfg)
+		sess = sess.Copy(aws.NewConfig().WithCredentials(webIdentity(sess)))
+	} else if len(options.CredentialsCmd) > 0 {
+		/* Run again shortly before the credentials expire, if they do */
+		creds := processcreds.NewCredentials(options.CredentialsCmd)
+		if _, err := creds.Get(); err != nil {
+			terminate(fmt.Sprintf("Credentials command failed: %s", err), ERR_NO_CREDENTIALS)
+		}
+
+		sess = session.New(cfg.WithCredentials(creds))
+	} else if useSharedConfig() || useDefaultChain() {
+		var err error
+		sess, err = session.NewSessionWithOptions(session.Options{
+			Config:            *cfg,
+			Profile:           options.Profile,
+			SharedConfigState: session.SharedConfigEnable,
+		})
+		if err != nil {
+			terminate(fmt.Sprintf("Unable to load AWS config: %s", err), ERR_NO_CREDENTIALS)
+		}
+
+		/* Fails here rather than on the first request, with a clearer message */
+		if _, err := sess.Config.Credentials.Get(); err != nil {
+			terminate(credentialsError(err), ERR_NO_CREDENTIALS)
+		}
+
+		if len(aws.StringValue(sess.Config.Region)) == 0 && !options.RegionFromBucket {
+			terminate("Please provide S3 region name", ERR_NO_CREDENTIALS)
+		}
+	} else {
+		creds := credentials.NewStaticCredentials(options.AccessKey, options.SecretKey, options.SessionToken)
+		_, err := creds.Get()
+		if err != nil {
+			fmt.Fprintf(notices, "Bad credentials: %s\n", err)
+		}
+
+		sess = session.New(cfg.WithCredentials(creds))
+	}
+
+	if len(options.RoleARN) > 0 && len(options.WebIdentityTokenFile) == 0 {
+		sess = sess.Copy(aws.NewConfig().WithCredentials(assumeRole(sess)))
+	}
+
+	if options.RegionFromBucket {
+		sess = sess.Copy(aws.NewConfig().WithRegion(bucketRegion(sess)))
+	}
+
+	return sess
+}
+
+// credentialsError explains why the SDK found no credentials, pointing at
+// aws sso login when the SSO session of the profile expired.
+func credentialsError(err error) string {
+	if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == ssocreds.ErrCodeSSOProviderInvalidToken {
+		login := "aws sso login"
+		if len(options.Profile) > 0 {
+			login += " --profile " + options.Profile
+		}
+		return fmt.Sprintf("The AWS SSO session expired or was never started, run %s first", login)
+	}
+
+	if useSharedConfig() {
+		profile := options.Profile
+		if len(profile) == 0 {
+			profile = "default"
+		}
+		return fmt.Sprintf("Unable to load AWS credentials of profile %s: %s", profile, err)
+	}
+
+	return fmt.Sprintf("No AWS credentials found, provide --access-key and --secret-key or a role: %s", err)
+}
+
+// stderrTokenProvider asks for the MFA code like stscreds.StdinTokenProvider,
+// but on stderr, as stdout may hold a result such as a presigned URL.
+func stderrTokenProvider() (string, error) {
+	fmt.Fprint(os.Stderr, "Assume Role MFA token code: ")
+
+	code, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && len(code) == 0 {
+		return "", err
+	}
+	return strings.TrimSpace(code), nil
+}
+
+// assumeRole returns the credentials of --role-arn, assumed with those of
+// sess and refreshed before they expire. With --mfa-serial they are cached
+// across runs instead, so a code is only asked for once they expire.
+func assumeRole(sess *session.Session) *credentials.Credentials {
+	if len(options.MFASerial) > 0 {
+		if cached := loadMFACredentials(); cached != nil {
+			return cached
+		}
+	}
+
+	creds := stscreds.NewCredentials(sess, options.RoleARN, func(p *stscreds.AssumeRoleProvider) {
+		p.RoleSessionName = options.RoleSessionName
+		p.Duration = options.RoleDuration
+		if len(options.ExternalID) > 0 {
+			p.ExternalID = aws.String(options.ExternalID)
+		}
+
+		if len(options.MFASerial) > 0 {
+			p.SerialNumber = aws.String(options.MFASerial)
+			if len(options.MFAToken) > 0 {
+				p.TokenCode = aws.String(options.MFAToken)
+			} else {
+				p.TokenProvider = stderrTokenProvider
+			}
+		}
+	})
+
+	if _, err := creds.Get(); err != nil {
+		terminate(fmt.Sprintf("Unable to assume role %s: %s", options.RoleARN, err), ERR_NO_CREDENTIALS)
+	}
+
+	if len(options.MFASerial) > 0 {
+		saveMFACredentials(creds)
+	}
+
+	return creds
+}
+
+// webIdentity returns the credentials of --role-arn, assumed with the OIDC
+// token in --web-identity-token-file. The file is read again whenever they
+// are refreshed.
+func webIdentity(sess *session.Session) *credentials.Credentials {
+	creds := stscreds.NewWebIdentityCredentials(sess, options.RoleARN, options.RoleSessionName, options.WebIdentityTokenFile)
+
+	if _, err := creds.Get(); err != nil {
+		terminate(fmt.Sprintf("Unable to assume role %s with web identity: %s", options.RoleARN, err), ERR_NO_CREDENTIALS)
+	}
+
+	return creds
+}
+
+// bucketRegion asks S3 where the bucket lives, avoiding the confusing
+// PermanentRedirect errors caused by a mismatched --region.
+func bucketRegion(sess *session.Session) string {
+	/* Any region of the bucket's partition answers, others reject the keys */
+	hint := options.Region
+	if len(hint) == 0 {
+		hint = aws.StringValue(sess.Config.Region)
+	}
+	if len(hint) == 0 {
+		hint = "us-east-1"
+	}
+
+	svc := s3.New(sess, aws.NewConfig().WithRegion(hint))
+	out, err := svc.GetBucketLocation(&s3.GetBucketLocationInput{
+		Bucket: aws.String(options.Bucket),
+	})
+	if err != nil {
+		terminate(fmt.Sprintf("Unable to look up bucket region: %s", err), ERR_NO_CREDENTIALS)
+	}
+
+	region := s3.NormalizeBucketLocation(aws.StringValue(out.LocationConstraint))
+	if len(options.Region) > 0 && region != options.Region {
+		fmt.Fprintf(notices, "Bucket %s is in %s, not %s\n", options.Bucket, region, options.Region)
+	}
+
+	return region
+}
+
+// setExpiry marks an upload as expiring after ttl. The Expires header and
+// the expires-at metadata are informational; removal is up to a bucket
+// lifecycle rule filtering on the bundle-cache-ttl tag.
+func setExpiry(params *s3.PutObjectInput, ttl time.Duration) {
+	expiresAt := time.Now().Add(ttl).UTC()
+	days := int((ttl + 24*time.Hour - 1) / (24 * time.Hour))
+
+	params.Expires = aws.Time(expiresAt)
+	params.Metadata = map[string]*string{
+		"expires-at": aws.String(expiresAt.Format(time.RFC3339)),
+	}
+	params.Tagging = aws.String(fmt.Sprintf("bundle-cache-ttl=%dd", days))
+}
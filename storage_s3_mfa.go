@@ -0,0 +1,92 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+)
+
+// Roles requiring MFA would ask for a code on every run, so with
+// --mfa-serial the credentials of the assumed role are cached in the user's
+// cache directory until shortly before they expire.
+
+// mfaCacheMargin is how long cached credentials must stay valid to be used,
+// enough for a transfer to finish with them.
+const mfaCacheMargin = 15 * time.Minute
+
+type cachedCredentials struct {
+	AccessKeyID     string    `json:"access_key_id"`
+	SecretAccessKey string    `json:"secret_access_key"`
+	SessionToken    string    `json:"session_token"`
+	Expiration      time.Time `json:"expiration"`
+}
+
+// mfaCachePath returns the cache file of the role session, or an empty
+// string without a cache directory.
+func mfaCachePath() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+
+	h := sha1.New()
+	fmt.Fprintf(h, "%s\x00%s\x00%s\x00%s", options.RoleARN, options.MFASerial, options.RoleSessionName, options.ExternalID)
+	return filepath.Join(dir, "bundle_cache", fmt.Sprintf("role-%x.json", h.Sum(nil)))
+}
+
+// loadMFACredentials returns the cached credentials of the role session,
+// or nil if there are none valid for long enough.
+func loadMFACredentials() *credentials.Credentials {
+	path := mfaCachePath()
+	if len(path) == 0 {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+
+	var cached cachedCredentials
+	if json.Unmarshal(data, &cached) != nil || time.Until(cached.Expiration) < mfaCacheMargin {
+		return nil
+	}
+
+	fmt.Fprintf(notices, "Using cached credentials of %s, valid until %s\n", options.RoleARN, cached.Expiration.Local().Format(time.Kitchen))
+	return credentials.NewStaticCredentials(cached.AccessKeyID, cached.SecretAccessKey, cached.SessionToken)
+}
+
+// saveMFACredentials caches the credentials of the role session. Failing to
+// do so only means asking for a code again next time.
+func saveMFACredentials(creds *credentials.Credentials) {
+	path := mfaCachePath()
+	if len(path) == 0 {
+		return
+	}
+
+	value, err := creds.Get()
+	if err != nil {
+		return
+	}
+	expiration, err := creds.ExpiresAt()
+	if err != nil {
+		return
+	}
+
+	data, _ := json.Marshal(cachedCredentials{value.AccessKeyID, value.SecretAccessKey, value.SessionToken, expiration})
+
+	/* Only readable by the user, like ~/.aws/cli/cache */
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		fmt.Fprintln(os.Stderr, "Warning: unable to cache role credentials:", err)
+		return
+	}
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		fmt.Fprintln(os.Stderr, "Warning: unable to cache role credentials:", err)
+	}
+}
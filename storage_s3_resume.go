@@ -0,0 +1,309 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// With --resume, transfers of archive files record their progress next to
+// the file, so a run after an interruption continues where the last one
+// stopped. Uploads keep the ID of the S3 multipart upload and skip the parts
+// S3 already holds with the same contents. Downloads keep the ranges written
+// to the file, as long as the object's ETag didn't change.
+
+// maxUploadParts is the S3 limit of parts per multipart upload.
+const maxUploadParts = 10000
+
+type uploadState struct {
+	Key      string `json:"key"`
+	UploadID string `json:"upload_id"`
+	Size     int64  `json:"size"`
+	PartSize int64  `json:"part_size"`
+}
+
+type downloadState struct {
+	ETag     string `json:"etag"`
+	Size     int64  `json:"size"`
+	PartSize int64  `json:"part_size"`
+	Done     []bool `json:"done"`
+}
+
+// resumableStorage reports whether every download goes to an S3 backend.
+// Other backends write the archive from the start, and without truncating
+// it first a longer leftover file would keep its stale tail.
+func resumableStorage() bool {
+	if len(options.BackendCmd) > 0 || len(options.FallbackStorage) > 0 || len(options.LocalCache) > 0 {
+		return false
+	}
+
+	switch options.Storage {
+	case "s3", "b2", "oss", "r2":
+		return true
+	}
+	return false
+}
+
+func resumeStatePath(file *os.File) string {
+	return file.Name() + ".resume.json"
+}
+
+func loadResumeState(file *os.File, state interface{}) bool {
+	data, err := ioutil.ReadFile(resumeStatePath(file))
+	if err != nil {
+		return false
+	}
+	return json.Unmarshal(data, state) == nil
+}
+
+func saveResumeState(file *os.File, state interface{}) error {
+	data, _ := json.Marshal(state)
+	return ioutil.WriteFile(resumeStatePath(file), data, 0644)
+}
+
+// uploadPartSize is --part-size, grown so the file fits in maxUploadParts.
+func uploadPartSize(size int64) int64 {
+	partSize := int64(options.PartSize)
+	if partSize <= 0 {
+		partSize = s3manager.DefaultUploadPartSize
+	}
+	if smallest := (size + maxUploadParts - 1) / maxUploadParts; partSize < smallest {
+		partSize = smallest
+	}
+	return partSize
+}
+
+// uploadedParts returns the ETags of the parts S3 holds for an upload, or
+// false if the upload is gone, e.g. completed or aborted.
+func (b *s3Backend) uploadedParts(key string, uploadID string) (map[int64]string, bool, error) {
+	parts := make(map[int64]string)
+
+	err := b.svc.ListPartsPagesWithContext(transferContext, &s3.ListPartsInput{
+		Bucket:       aws.String(b.bucket),
+		Key:          aws.String(key),
+		RequestPayer: b.requestPayer,
+		UploadId:     aws.String(uploadID),
+	}, func(page *s3.ListPartsOutput, lastPage bool) bool {
+		for _, part := range page.Parts {
+			parts[aws.Int64Value(part.PartNumber)] = aws.StringValue(part.ETag)
+		}
+		return true
+	})
+	if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == s3.ErrCodeNoSuchUpload {
+		return nil, false, nil
+	}
+
+	return parts, err == nil, err
+}
+
+func (b *s3Backend) createUpload(key string, file *os.File, size int64) (*uploadState, error) {
+	params := &s3.PutObjectInput{}
+	if options.ExpireAfter > 0 {
+		setExpiry(params, options.ExpireAfter)
+		if b.noTagging {
+			params.Tagging = nil
+		}
+	}
+
+	out, err := b.svc.CreateMultipartUploadWithContext(transferContext, &s3.CreateMultipartUploadInput{
+		Bucket:       aws.String(b.bucket),
+		Key:          aws.String(key),
+		RequestPayer: b.requestPayer,
+		ContentType:  aws.String(detectContentType(file)),
+		Expires:      params.Expires,
+		Metadata:     params.Metadata,
+		Tagging:      params.Tagging,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	state := &uploadState{Key: key, UploadID: aws.StringValue(out.UploadId), Size: size, PartSize: uploadPartSize(size)}
+	return state, saveResumeState(file, state)
+}
+
+// partETag returns the ETag S3 gives a part without SSE-KMS encryption.
+func partETag(part io.Reader) (string, error) {
+	hash := md5.New()
+	if _, err := io.Copy(hash, part); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%q", fmt.Sprintf("%x", hash.Sum(nil))), nil
+}
+
+// resumeUpload uploads file as a multipart upload that a later run with
+// the same archive continues. The upload is left in place on errors, so
+// incomplete uploads should be cleaned up by a bucket lifecycle rule.
+func (b *s3Backend) resumeUpload(key string, file *os.File, size int64) error {
+	var state uploadState
+	var uploaded map[int64]string
+
+	if loadResumeState(file, &state) && state.Key == key && state.Size == size {
+		var found bool
+		var err error
+		if uploaded, found, err = b.uploadedParts(key, state.UploadID); err != nil {
+			return err
+		}
+		if found {
+			fmt.Printf("Resuming upload with %d parts done...\n", len(uploaded))
+		} else {
+			state = uploadState{}
+		}
+	} else {
+		state = uploadState{}
+	}
+
+	if len(state.UploadID) == 0 {
+		created, err := b.createUpload(key, file, size)
+		if err != nil {
+			return err
+		}
+		state = *created
+	}
+
+	var mutex sync.Mutex
+	var parts []*s3.CompletedPart
+
+	err := forEachRange(size, state.PartSize, options.UploadConcurrency, func(i int, offset int64, length int64) error {
+		number := int64(i + 1)
+
+		etag, err := partETag(io.NewSectionReader(file, offset, length))
+		if err != nil {
+			return err
+		}
+
+		if uploaded[number] != etag {
+			out, err := b.svc.UploadPartWithContext(transferContext, &s3.UploadPartInput{
+				Bucket:        aws.String(b.bucket),
+				Key:           aws.String(key),
+				RequestPayer:  b.requestPayer,
+				UploadId:      aws.String(state.UploadID),
+				PartNumber:    aws.Int64(number),
+				Body:          io.NewSectionReader(file, offset, length),
+				ContentLength: aws.Int64(length),
+			})
+			if err != nil {
+				return err
+			}
+			etag = aws.StringValue(out.ETag)
+		}
+
+		mutex.Lock()
+		parts = append(parts, &s3.CompletedPart{ETag: aws.String(etag), PartNumber: aws.Int64(number)})
+		mutex.Unlock()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(parts, func(i, j int) bool {
+		return aws.Int64Value(parts[i].PartNumber) < aws.Int64Value(parts[j].PartNumber)
+	})
+
+	_, err = b.svc.CompleteMultipartUploadWithContext(transferContext, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(b.bucket),
+		Key:             aws.String(key),
+		RequestPayer:    b.requestPayer,
+		UploadId:        aws.String(state.UploadID),
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+	})
+	if err != nil {
+		return err
+	}
+
+	os.Remove(resumeStatePath(file))
+	return nil
+}
+
+// resumeDownload fetches the ranges of key missing from file, recording
+// every finished one.
+func (b *s3Backend) resumeDownload(key string, file *os.File) (int64, error) {
+	head, err := b.svc.HeadObjectWithContext(transferContext, &s3.HeadObjectInput{
+		Bucket:       aws.String(b.bucket),
+		Key:          aws.String(key),
+		RequestPayer: b.requestPayer,
+	})
+	if err != nil {
+		return 0, err
+	}
+	size := aws.Int64Value(head.ContentLength)
+	setProgressTotal(size)
+
+	partSize, concurrency := downloadTuning(size)
+	if options.PartSize > 0 {
+		partSize = int64(options.PartSize)
+	}
+	if options.DownloadConcurrency > 0 {
+		concurrency = options.DownloadConcurrency
+	}
+
+	var state downloadState
+	info, statErr := file.Stat()
+	if !loadResumeState(file, &state) || state.ETag != aws.StringValue(head.ETag) || state.Size != size || statErr != nil || info.Size() != size {
+		state = downloadState{ETag: aws.StringValue(head.ETag), Size: size, PartSize: partSize}
+		state.Done = make([]bool, (size+partSize-1)/partSize)
+		if err := file.Truncate(size); err != nil {
+			return 0, err
+		}
+	} else {
+		done := 0
+		for _, finished := range state.Done {
+			if finished {
+				done++
+			}
+		}
+		fmt.Printf("Resuming download with %d of %d parts done...\n", done, len(state.Done))
+	}
+
+	var mutex sync.Mutex
+
+	err = forEachRange(size, state.PartSize, concurrency, func(i int, offset int64, length int64) error {
+		mutex.Lock()
+		finished := state.Done[i]
+		mutex.Unlock()
+		if finished {
+			return nil
+		}
+
+		out, err := b.svc.GetObjectWithContext(transferContext, &s3.GetObjectInput{
+			Bucket:       aws.String(b.bucket),
+			Key:          aws.String(key),
+			RequestPayer: b.requestPayer,
+			Range:        aws.String(fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)),
+		})
+		if err != nil {
+			return err
+		}
+		defer out.Body.Close()
+
+		written, err := io.Copy(io.NewOffsetWriter(file, offset), out.Body)
+		if err == nil && written != length {
+			err = fmt.Errorf("expected %d bytes, got %d", length, written)
+		}
+		if err != nil {
+			return err
+		}
+
+		mutex.Lock()
+		defer mutex.Unlock()
+		state.Done[i] = true
+		return saveResumeState(file, &state)
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	os.Remove(resumeStatePath(file))
+	return size, nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// sftpBackend stores archives in a directory on a remote host over SSH.
+type sftpBackend struct {
+	client *sftp.Client
+	root   string
+}
+
+func sshClientConfig() *ssh.ClientConfig {
+	if len(options.SSHKey) == 0 {
+		terminate("Please provide --ssh-key", ERR_NO_CREDENTIALS)
+	}
+
+	pem, err := ioutil.ReadFile(options.SSHKey)
+	if err != nil {
+		terminate(fmt.Sprintf("Unable to read SSH key: %s", err), ERR_NO_CREDENTIALS)
+	}
+
+	signer, err := ssh.ParsePrivateKey(pem)
+	if err != nil {
+		terminate(fmt.Sprintf("Unable to parse SSH key: %s", err), ERR_NO_CREDENTIALS)
+	}
+
+	knownHostsPath := options.KnownHosts
+	if len(knownHostsPath) == 0 {
+		home, _ := os.UserHomeDir()
+		knownHostsPath = filepath.Join(home, ".ssh", "known_hosts")
+	}
+
+	hostKeyCallback, err := knownhosts.New(knownHostsPath)
+	if err != nil {
+		terminate(fmt.Sprintf("Unable to read known hosts: %s", err), ERR_NO_CREDENTIALS)
+	}
+
+	return &ssh.ClientConfig{
+		User:            options.User,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         options.ConnectTimeout,
+	}
+}
+
+func newSFTPBackend() Backend {
+	if len(options.Host) == 0 {
+		terminate("Please provide SFTP host", ERR_WRONG_USAGE)
+	}
+
+	if len(options.User) == 0 {
+		terminate("Please provide SFTP user", ERR_WRONG_USAGE)
+	}
+
+	address := options.Host
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(address, "22")
+	}
+
+	conn, err := ssh.Dial("tcp", address, sshClientConfig())
+	if err != nil {
+		terminate(fmt.Sprintf("Unable to connect to %s: %s", address, err), ERR_NO_CREDENTIALS)
+	}
+
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		terminate(fmt.Sprintf("Unable to start SFTP session: %s", err), 1)
+	}
+
+	root := options.CacheDir
+	if len(root) == 0 {
+		root = "."
+	}
+
+	return &sftpBackend{client: client, root: root}
+}
+
+func (b *sftpBackend) path(key string) string {
+	return path.Join(b.root, strings.TrimPrefix(key, "/"))
+}
+
+func (b *sftpBackend) Put(key string, body io.ReadSeeker, size int64) error {
+	target := b.path(key)
+	if err := b.client.MkdirAll(path.Dir(target)); err != nil {
+		return err
+	}
+
+	tmp := fmt.Sprintf("%s.%d.partial", target, os.Getpid())
+	file, err := b.client.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(file, body)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		b.client.Remove(tmp)
+		return err
+	}
+
+	return b.client.PosixRename(tmp, target)
+}
+
+func (b *sftpBackend) Get(key string) (io.ReadCloser, error) {
+	return b.client.Open(b.path(key))
+}
+
+func (b *sftpBackend) Exists(key string) (bool, error) {
+	_, err := b.client.Stat(b.path(key))
+	if err == nil {
+		return true, nil
+	}
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return false, err
+}
+
+func (b *sftpBackend) Delete(key string) error {
+	err := b.client.Remove(b.path(key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (b *sftpBackend) List(prefix string) ([]string, error) {
+	var keys []string
+
+	walker := b.client.Walk(b.root)
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			return nil, err
+		}
+
+		/* Skip directories and uploads still in progress */
+		if walker.Stat().IsDir() || strings.HasSuffix(walker.Path(), ".partial") {
+			continue
+		}
+
+		name, err := filepath.Rel(b.root, walker.Path())
+		if err != nil {
+			return nil, err
+		}
+
+		key := storedKey(prefix, filepath.ToSlash(name))
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys, nil
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Swift support authenticates against Keystone v3 and then stores objects
+// through the plain HTTP backend. Credentials are read from the usual
+// OS_* environment variables, as set by an openrc file.
+
+type keystoneCatalog struct {
+	Token struct {
+		Catalog []struct {
+			Type      string `json:"type"`
+			Endpoints []struct {
+				Interface string `json:"interface"`
+				Region    string `json:"region"`
+				URL       string `json:"url"`
+			} `json:"endpoints"`
+		} `json:"catalog"`
+	} `json:"token"`
+}
+
+func envOrDefault(name string, value string) string {
+	if envDefined(name) {
+		return os.Getenv(name)
+	}
+	return value
+}
+
+func keystoneAuthRequest() map[string]interface{} {
+	if envDefined("OS_APPLICATION_CREDENTIAL_ID") {
+		return map[string]interface{}{
+			"identity": map[string]interface{}{
+				"methods": []string{"application_credential"},
+				"application_credential": map[string]string{
+					"id":     os.Getenv("OS_APPLICATION_CREDENTIAL_ID"),
+					"secret": os.Getenv("OS_APPLICATION_CREDENTIAL_SECRET"),
+				},
+			},
+		}
+	}
+
+	if !envDefined("OS_USERNAME") || !envDefined("OS_PASSWORD") || !envDefined("OS_PROJECT_NAME") {
+		terminate("Please provide OS_USERNAME, OS_PASSWORD and OS_PROJECT_NAME or an application credential", ERR_NO_CREDENTIALS)
+	}
+
+	return map[string]interface{}{
+		"identity": map[string]interface{}{
+			"methods": []string{"password"},
+			"password": map[string]interface{}{
+				"user": map[string]interface{}{
+					"name":     os.Getenv("OS_USERNAME"),
+					"password": os.Getenv("OS_PASSWORD"),
+					"domain":   map[string]string{"name": envOrDefault("OS_USER_DOMAIN_NAME", "Default")},
+				},
+			},
+		},
+		"scope": map[string]interface{}{
+			"project": map[string]interface{}{
+				"name":   os.Getenv("OS_PROJECT_NAME"),
+				"domain": map[string]string{"name": envOrDefault("OS_PROJECT_DOMAIN_NAME", "Default")},
+			},
+		},
+	}
+}
+
+// keystoneAuth returns a token and the public object-store endpoint.
+func keystoneAuth(client *http.Client) (string, string, error) {
+	authURL := strings.TrimSuffix(os.Getenv("OS_AUTH_URL"), "/")
+	if !strings.HasSuffix(authURL, "/v3") {
+		authURL += "/v3"
+	}
+
+	body, _ := json.Marshal(map[string]interface{}{"auth": keystoneAuthRequest()})
+	resp, err := client.Post(authURL+"/auth/tokens", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return "", "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return "", "", fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(message)))
+	}
+
+	var catalog keystoneCatalog
+	if err := json.NewDecoder(resp.Body).Decode(&catalog); err != nil {
+		return "", "", err
+	}
+
+	region := os.Getenv("OS_REGION_NAME")
+	for _, service := range catalog.Token.Catalog {
+		if service.Type != "object-store" {
+			continue
+		}
+		for _, endpoint := range service.Endpoints {
+			if endpoint.Interface == "public" && (len(region) == 0 || endpoint.Region == region) {
+				return resp.Header.Get("X-Subject-Token"), endpoint.URL, nil
+			}
+		}
+	}
+
+	return "", "", fmt.Errorf("no public object-store endpoint in service catalog")
+}
+
+func newSwiftBackend() Backend {
+	if !envDefined("OS_AUTH_URL") {
+		terminate("Please provide OS_AUTH_URL", ERR_NO_CREDENTIALS)
+	}
+
+	if len(options.SwiftContainer) == 0 {
+		terminate("Please provide Swift container name", ERR_WRONG_USAGE)
+	}
+
+	client := http.DefaultClient
+	if needsCustomTransport() {
+		client = newHTTPClient()
+	}
+
+	token, endpoint, err := keystoneAuth(client)
+	if err != nil {
+		terminate(fmt.Sprintf("Keystone authentication failed: %s", err), ERR_NO_CREDENTIALS)
+	}
+
+	return &swiftBackend{&httpBackend{
+		url:     fmt.Sprintf("%s/%s", strings.TrimSuffix(endpoint, "/"), options.SwiftContainer),
+		headers: map[string]string{"X-Auth-Token": token},
+		client:  client,
+	}}
+}
+
+// swiftBackend is the HTTP backend plus container listings.
+type swiftBackend struct {
+	*httpBackend
+}
+
+// List pages through the container listing, which returns at most 10000
+// names per request.
+func (b *swiftBackend) List(prefix string) ([]string, error) {
+	var keys []string
+	marker := ""
+
+	for {
+		query := url.Values{
+			"format": {"json"},
+			"prefix": {strings.TrimPrefix(prefix, "/")},
+			"marker": {marker},
+		}
+
+		req, err := http.NewRequestWithContext(transferContext, "GET", fmt.Sprintf("%s?%s", b.url, query.Encode()), nil)
+		if err != nil {
+			return nil, err
+		}
+		b.authorize(req)
+
+		resp, err := b.do(req)
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode == http.StatusNotFound {
+			resp.Body.Close()
+			return nil, fmt.Errorf("container %s not found", options.SwiftContainer)
+		}
+
+		var objects []struct {
+			Name string `json:"name"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&objects)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		if len(objects) == 0 {
+			return keys, nil
+		}
+
+		for _, object := range objects {
+			keys = append(keys, storedKey(prefix, object.Name))
+		}
+		marker = objects[len(objects)-1].Name
+	}
+}
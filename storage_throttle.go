@@ -0,0 +1,126 @@
+package main
+
+import (
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// throttleChunk is the most read at once, so the rate stays smooth.
+const throttleChunk = 64 << 10
+
+// throttleBurst is how far transfers may catch up after falling behind,
+// e.g. by sleeping longer than asked.
+const throttleBurst = 100 * time.Millisecond
+
+// rateLimiter spreads transfers over time at a fixed rate, shared by all
+// concurrent transfers.
+type rateLimiter struct {
+	mutex sync.Mutex
+	rate  float64
+	// next is when the bytes granted so far are due.
+	next time.Time
+}
+
+// wait blocks until n more bytes fit in the rate.
+func (l *rateLimiter) wait(n int) {
+	l.mutex.Lock()
+	now := time.Now()
+	if earliest := now.Add(-throttleBurst); l.next.Before(earliest) {
+		l.next = earliest
+	}
+	l.next = l.next.Add(time.Duration(float64(n) / l.rate * float64(time.Second)))
+	delay := l.next.Sub(now)
+	l.mutex.Unlock()
+
+	time.Sleep(delay)
+}
+
+type throttledReader struct {
+	io.Reader
+	limiter *rateLimiter
+}
+
+func (r throttledReader) Read(p []byte) (int, error) {
+	if len(p) > throttleChunk {
+		p = p[:throttleChunk]
+	}
+
+	n, err := r.Reader.Read(p)
+	r.limiter.wait(n)
+	return n, err
+}
+
+type throttledReadSeeker struct {
+	throttledReader
+	seeker io.Seeker
+}
+
+func (r throttledReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	return r.seeker.Seek(offset, whence)
+}
+
+type throttledReadCloser struct {
+	throttledReader
+	closer io.Closer
+}
+
+func (r throttledReadCloser) Close() error {
+	return r.closer.Close()
+}
+
+// throttledBackend limits everything read from and sent to storage to
+// --max-bandwidth. Downloads to a file use a single Get, as parallel ranged
+// requests gain nothing under the limit.
+type throttledBackend struct {
+	Backend
+	limiter *rateLimiter
+}
+
+// throttledStreamBackend keeps streaming uploads of backends supporting
+// them.
+type throttledStreamBackend struct {
+	*throttledBackend
+}
+
+func (b throttledStreamBackend) PutStream(key string, body io.Reader) error {
+	return b.Backend.(streamUploader).PutStream(key, throttledReader{body, b.limiter})
+}
+
+func newThrottledBackend(backend Backend) Backend {
+	/* rsync limits itself with --bwlimit */
+	if _, ok := backend.(treeSyncer); ok || options.MaxBandwidth <= 0 {
+		return backend
+	}
+
+	throttled := &throttledBackend{Backend: backend, limiter: &rateLimiter{rate: float64(options.MaxBandwidth)}}
+	if _, ok := backend.(streamUploader); ok {
+		return throttledStreamBackend{throttled}
+	}
+
+	return throttled
+}
+
+func (b *throttledBackend) Put(key string, body io.ReadSeeker, size int64) error {
+	return b.Backend.Put(key, throttledReadSeeker{throttledReader{body, b.limiter}, body}, size)
+}
+
+func (b *throttledBackend) Get(key string) (io.ReadCloser, error) {
+	body, err := b.Backend.Get(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return throttledReadCloser{throttledReader{body, b.limiter}, body}, nil
+}
+
+func (b *throttledBackend) DownloadFile(key string, file *os.File) (int64, error) {
+	body, err := b.Get(key)
+	if err != nil {
+		return 0, err
+	}
+	defer body.Close()
+
+	return io.Copy(file, body)
+}
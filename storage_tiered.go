@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// tieredBackend puts a local directory in front of remote storage. Reads are
+// served locally when possible and fill the local tier on remote hits,
+// writes go to both. Failures of the local tier only print a warning.
+type tieredBackend struct {
+	local  *fileBackend
+	remote Backend
+}
+
+func newTieredBackend(remote Backend) Backend {
+	if err := os.MkdirAll(options.LocalCache, 0755); err != nil {
+		terminate(fmt.Sprintf("Unable to create local cache %s: %s", options.LocalCache, err), ERR_FILE_ACCESS)
+	}
+
+	return &tieredBackend{local: &fileBackend{root: options.LocalCache}, remote: remote}
+}
+
+func (b *tieredBackend) Put(key string, body io.ReadSeeker, size int64) error {
+	if err := b.remote.Put(key, body, size); err != nil {
+		return err
+	}
+
+	if _, err := body.Seek(0, io.SeekStart); err == nil {
+		err = b.local.Put(key, body, size)
+		if err != nil {
+			fmt.Printf("Unable to write local cache: %s\n", err)
+		}
+	}
+
+	return nil
+}
+
+// fill downloads key from the remote tier into the local one.
+func (b *tieredBackend) fill(key string) error {
+	path := b.local.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".bundle_cache")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = downloadFile(b.remote, key, tmp)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+func (b *tieredBackend) Get(key string) (io.ReadCloser, error) {
+	if found, _ := b.local.Exists(key); found {
+		fmt.Println("Found in local cache")
+		return b.local.Get(key)
+	}
+
+	/* A missing key fails the fill and the direct read alike */
+	if err := b.fill(key); err != nil {
+		body, getErr := b.remote.Get(key)
+		if getErr != nil {
+			return nil, getErr
+		}
+
+		fmt.Printf("Unable to fill local cache: %s\n", err)
+		return body, nil
+	}
+
+	return b.local.Get(key)
+}
+
+func (b *tieredBackend) Exists(key string) (bool, error) {
+	if found, _ := b.local.Exists(key); found {
+		return true, nil
+	}
+
+	return b.remote.Exists(key)
+}
+
+func (b *tieredBackend) Delete(key string) error {
+	if err := b.local.Delete(key); err != nil {
+		fmt.Printf("Unable to delete from local cache: %s\n", err)
+	}
+
+	return b.remote.Delete(key)
+}
+
+// List returns the remote keys, the local tier only ever holds a subset.
+func (b *tieredBackend) List(prefix string) ([]string, error) {
+	return b.remote.List(prefix)
+}
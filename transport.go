@@ -0,0 +1,142 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// idleConnsPerHost is how many connections to storage are kept open between
+// requests. Go keeps 2, too few for the parallel requests of chunked and
+// split archives, most of which would then open a new connection and do a
+// new TLS handshake.
+const idleConnsPerHost = 32
+
+func needsCustomTransport() bool {
+	return len(options.CABundle) > 0 || options.InsecureSkipVerify || options.ConnectTimeout > 0 ||
+		progressMode() != "none" || options.Chunked || options.SplitByDir || len(options.Proxy) > 0
+}
+
+// insecureWarning warns about --insecure-skip-verify once, however many
+// backends build a TLS config.
+var insecureWarning sync.Once
+
+// newTLSConfig trusts the certificates from --ca-bundle in addition to the
+// system roots.
+func newTLSConfig() *tls.Config {
+	tlsConfig := &tls.Config{}
+
+	if len(options.CABundle) > 0 {
+		pem, err := ioutil.ReadFile(options.CABundle)
+		if err != nil {
+			terminate(fmt.Sprintf("Unable to read CA bundle: %s", err), 1)
+		}
+
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			terminate(fmt.Sprintf("No certificates found in %s", options.CABundle), 1)
+		}
+
+		tlsConfig.RootCAs = pool
+	}
+
+	if options.InsecureSkipVerify {
+		insecureWarning.Do(func() {
+			fmt.Fprintln(os.Stderr, "Warning: TLS certificate verification is disabled")
+		})
+		tlsConfig.InsecureSkipVerify = true
+	}
+
+	return tlsConfig
+}
+
+// newHTTPClient returns the client used for S3 requests, with the TLS
+// settings from newTLSConfig and --connect-timeout, counting progress.
+// Connections are kept alive and use HTTP/2 where the server supports it, so
+// parallel requests share a connection.
+func newHTTPClient() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = newTLSConfig()
+	transport.MaxIdleConnsPerHost = idleConnsPerHost
+
+	/* A custom TLS config turns HTTP/2 off otherwise */
+	transport.ForceAttemptHTTP2 = true
+
+	if options.ConnectTimeout > 0 {
+		dialer := &net.Dialer{Timeout: options.ConnectTimeout, KeepAlive: 30 * time.Second}
+		transport.DialContext = dialer.DialContext
+		transport.TLSHandshakeTimeout = options.ConnectTimeout
+	}
+
+	if len(options.Proxy) > 0 {
+		proxy, err := url.Parse(options.Proxy)
+		if err != nil || len(proxy.Host) == 0 {
+			terminate(fmt.Sprintf("Invalid proxy URL %q", options.Proxy), ERR_WRONG_USAGE)
+		}
+		transport.Proxy = proxyFunc(proxy)
+	}
+
+	return &http.Client{Transport: progressTransport{transport}}
+}
+
+// proxyFunc sends requests through proxy, authenticating with the user and
+// password of its URL, except to hosts in NO_PROXY and loopback addresses,
+// like HTTPS_PROXY.
+func proxyFunc(proxy *url.URL) func(*http.Request) (*url.URL, error) {
+	noProxy := os.Getenv("NO_PROXY")
+	if len(noProxy) == 0 {
+		noProxy = os.Getenv("no_proxy")
+	}
+
+	return func(req *http.Request) (*url.URL, error) {
+		if bypassProxy(strings.ToLower(req.URL.Hostname()), noProxy) {
+			return nil, nil
+		}
+		return proxy, nil
+	}
+}
+
+// bypassProxy reports whether host matches noProxy, a comma separated list
+// of domains, which include their subdomains, IP addresses and CIDR ranges.
+func bypassProxy(host string, noProxy string) bool {
+	ip := net.ParseIP(host)
+	if host == "localhost" || (ip != nil && ip.IsLoopback()) {
+		return true
+	}
+
+	for _, entry := range strings.Split(noProxy, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if name, _, err := net.SplitHostPort(entry); err == nil {
+			entry = name
+		}
+
+		if entry == "*" {
+			return true
+		}
+
+		if _, network, err := net.ParseCIDR(entry); err == nil {
+			if ip != nil && network.Contains(ip) {
+				return true
+			}
+			continue
+		}
+
+		entry = strings.TrimPrefix(strings.TrimPrefix(entry, "*"), ".")
+		if len(entry) > 0 && (host == entry || strings.HasSuffix(host, "."+entry)) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"compress/flate"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+)
+
+var zipMagic = []byte{'P', 'K', 0x03, 0x04}
+
+// archiveFormat returns --format, which defaults to zip on Windows, where
+// runners often lack tar and gzip to inspect archives with.
+func archiveFormat() string {
+	format := options.Format
+	if len(format) == 0 {
+		format = "tar"
+		if runtime.GOOS == "windows" {
+			format = "zip"
+		}
+	}
+
+	if format != "tar" && format != "zip" {
+		terminate(fmt.Sprintf("Unknown format %q, use tar or zip", options.Format), ERR_WRONG_USAGE)
+	}
+
+	return format
+}
+
+// archiveExt returns the extension of archives in the selected format.
+// Images are always stored as the tarball docker save writes.
+func archiveExt() string {
+	if archiveFormat() == "zip" && len(options.Image) == 0 {
+		return ".zip"
+	}
+	return archiveCodec().Ext
+}
+
+// writeZip converts the tar entries written by fn to a zip file written to
+// w, so archives are built the same way in either format. Entries are
+// deflated at --compression-level, --compression doesn't apply.
+func writeZip(w io.Writer, fn func(*tar.Writer) error) error {
+	reader, writer := io.Pipe()
+
+	converted := make(chan error, 1)
+	go func() {
+		err := tarToZip(reader, w)
+		/* Unblocks fn if the conversion failed half way */
+		reader.CloseWithError(err)
+		converted <- err
+	}()
+
+	archive := tar.NewWriter(countingWriter{writer, &archivedBytes})
+	err := fn(archive)
+	if err == nil {
+		err = archive.Close()
+	}
+	writer.CloseWithError(err)
+
+	if convertErr := <-converted; err == nil {
+		err = convertErr
+	}
+	return err
+}
+
+func tarToZip(reader io.Reader, w io.Writer) error {
+	level := options.CompressionLevel
+
+	archive := zip.NewWriter(w)
+	archive.RegisterCompressor(zip.Deflate, func(out io.Writer) (io.WriteCloser, error) {
+		return flate.NewWriter(out, level)
+	})
+
+	entries := tar.NewReader(reader)
+	for {
+		header, err := entries.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		zipHeader, err := zip.FileInfoHeader(header.FileInfo())
+		if err != nil {
+			return err
+		}
+		zipHeader.Name = header.Name
+		zipHeader.Method = zip.Deflate
+		if level == 0 || header.Typeflag != tar.TypeReg {
+			zipHeader.Method = zip.Store
+		}
+
+		contents, err := archive.CreateHeader(zipHeader)
+		if err != nil {
+			return err
+		}
+
+		/* Like Info-ZIP, symlinks are stored with their target as contents */
+		if header.Typeflag == tar.TypeSymlink {
+			_, err = io.WriteString(contents, header.Linkname)
+		} else {
+			_, err = io.Copy(contents, entries)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return archive.Close()
+}
+
+// walkZip calls fn for every entry of a zip file like walkArchive. The
+// central directory is at the end of the file, so an archive streamed from
+// storage is written to a temporary file first.
+func walkZip(reader io.Reader, buffered *bufio.Reader, fn func(*tar.Header, io.Reader) error) error {
+	file, ok := reader.(*os.File)
+	if !ok {
+		temp, err := os.CreateTemp("", "bundle_cache-*.zip")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(temp.Name())
+		defer temp.Close()
+
+		if _, err := io.Copy(temp, buffered); err != nil {
+			return err
+		}
+		file = temp
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	archive, err := zip.NewReader(file, info.Size())
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range archive.File {
+		if err := walkZipEntry(entry, fn); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func walkZipEntry(entry *zip.File, fn func(*tar.Header, io.Reader) error) error {
+	contents, err := entry.Open()
+	if err != nil {
+		return err
+	}
+	defer contents.Close()
+
+	var link string
+	if entry.Mode()&os.ModeSymlink != 0 {
+		target, err := io.ReadAll(contents)
+		if err != nil {
+			return err
+		}
+		link = string(target)
+	}
+
+	header, err := tar.FileInfoHeader(entry.FileInfo(), link)
+	if err != nil {
+		return err
+	}
+	header.Name = entry.Name
+
+	return fn(header, contents)
+}